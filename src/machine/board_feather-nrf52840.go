@@ -71,8 +71,8 @@ const (
 
 // UART0 pins (logical UART1)
 const (
-	UART_RX_PIN = D0
-	UART_TX_PIN = D1
+	UART_TX_PIN = D0
+	UART_RX_PIN = D1
 )
 
 // UART0 is the USB device
@@ -0,0 +1,93 @@
+// +build microbit_v2
+
+package machine
+
+// The micro:bit v2 does not have a 32kHz crystal on board.
+const HasLowFrequencyCrystal = false
+
+// Buttons on the micro:bit v2 (A and B)
+const (
+	BUTTON  Pin = BUTTONA
+	BUTTONA Pin = P0_14 // P5 on the board
+	BUTTONB Pin = P0_23 // P11 on the board
+)
+
+// UART pins, connected to the interface chip which provides the USB serial
+// port.
+const (
+	UART_TX_PIN Pin = P0_06
+	UART_RX_PIN Pin = P1_08
+)
+
+// ADC pins
+const (
+	ADC0 Pin = P0_02 // P0 on the board
+	ADC1 Pin = P0_03 // P1 on the board
+	ADC2 Pin = P0_04 // P2 on the board
+)
+
+// I2C pins of the edge connector. The motion sensor and the interface chip
+// are on a separate internal bus.
+const (
+	SDA_PIN Pin = P1_00 // P20 on the board
+	SCL_PIN Pin = P0_26 // P19 on the board
+
+	SDA_INTERNAL_PIN Pin = P0_16
+	SCL_INTERNAL_PIN Pin = P0_08
+)
+
+// SPI pins
+const (
+	SPI0_SCK_PIN Pin = P0_17 // P13 on the board
+	SPI0_SDO_PIN Pin = P0_13 // P15 on the board
+	SPI0_SDI_PIN Pin = P0_01 // P14 on the board
+)
+
+// GPIO/Analog pins of the edge connector. P8 and P9 are the NFC antenna pins of
+// the nrf52833, which can only be used as GPIO once they are configured as
+// such in the UICR (see ErrNFCPin).
+const (
+	P0  Pin = P0_02
+	P1  Pin = P0_03
+	P2  Pin = P0_04
+	P3  Pin = P0_31
+	P4  Pin = P0_28
+	P5  Pin = P0_14
+	P6  Pin = P1_05
+	P7  Pin = P0_11
+	P8  Pin = P0_10
+	P9  Pin = P0_09
+	P10 Pin = P0_30
+	P11 Pin = P0_23
+	P12 Pin = P0_12
+	P13 Pin = P0_17
+	P14 Pin = P0_01
+	P15 Pin = P0_13
+	P16 Pin = P1_02
+	P19 Pin = P0_26
+	P20 Pin = P1_00
+)
+
+// Other on-board peripherals
+const (
+	SPEAKER_PIN    Pin = P0_00
+	MIC_PIN        Pin = P0_05 // analog input of the microphone
+	MIC_ENABLE_PIN Pin = P0_20 // drive high to power the microphone
+	LOGO_TOUCH_PIN Pin = P1_04 // the touch sensitive logo
+	I2C_INT_PIN    Pin = P0_25 // interrupt of the internal I2C bus
+)
+
+// LED matrix pins. The matrix has 5 rows and 5 columns: an LED is lit when its
+// row is high and its column is low.
+const (
+	LED_COL_1 Pin = P0_28
+	LED_COL_2 Pin = P0_11
+	LED_COL_3 Pin = P0_31
+	LED_COL_4 Pin = P1_05
+	LED_COL_5 Pin = P0_30
+	LED_ROW_1 Pin = P0_21
+	LED_ROW_2 Pin = P0_22
+	LED_ROW_3 Pin = P0_15
+	LED_ROW_4 Pin = P0_24
+	LED_ROW_5 Pin = P0_19
+)
@@ -0,0 +1,65 @@
+// +build pca10059
+
+package machine
+
+const HasLowFrequencyCrystal = false
+
+// LEDs on the pca10059 (nRF52840 dongle)
+const (
+	LED  Pin = LED1
+	LED1 Pin = 6 // P0.06, green
+
+	// RGB LED
+	LED2       Pin = LED2_RED
+	LED2_RED   Pin = 8  // P0.08
+	LED2_GREEN Pin = 41 // P1.09
+	LED2_BLUE  Pin = 12 // P0.12
+)
+
+// Buttons on the pca10059
+const (
+	BUTTON  Pin = BUTTON1
+	BUTTON1 Pin = 38 // P1.06, SW1
+)
+
+// UART pins
+const (
+	UART_TX_PIN Pin = 20 // P0.20
+	UART_RX_PIN Pin = 24 // P0.24
+)
+
+// UART0 is the USB device
+var (
+	UART0 = USB
+)
+
+// ADC pins
+const (
+	ADC0 Pin = 2  // P0.02
+	ADC1 Pin = 29 // P0.29
+	ADC2 Pin = 31 // P0.31
+)
+
+// I2C pins
+const (
+	SDA_PIN Pin = 13 // P0.13
+	SCL_PIN Pin = 15 // P0.15
+)
+
+// SPI pins
+const (
+	SPI0_SCK_PIN Pin = 47 // P1.15
+	SPI0_SDO_PIN Pin = 45 // P1.13
+	SPI0_SDI_PIN Pin = 42 // P1.10
+)
+
+// USB CDC identifiers
+const (
+	usb_STRING_PRODUCT      = "Nordic nRF52840 Dongle (PCA10059)"
+	usb_STRING_MANUFACTURER = "Nordic Semiconductor"
+)
+
+var (
+	usb_VID uint16 = 0x1915
+	usb_PID uint16 = 0x520F
+)
@@ -1,52 +1,138 @@
 package machine
 
 import (
+	"runtime/interrupt"
 	"runtime/volatile"
 )
 
+// bufferSize is the default size of a RingBuffer in bytes.
 const bufferSize = 128
 
+// maxBufferSize is the largest size a RingBuffer can have. It must fit in the
+// 16-bit free-running head and tail counters.
+const maxBufferSize = 32768
+
 // RingBuffer is ring buffer implementation inspired by post at
 // https://www.embeddedrelated.com/showthread/comp.arch.embedded/77084-1.php
+//
+// The zero value is a buffer of the default size (128 bytes), which needs no
+// allocation. Resize can replace the storage with a buffer of another size.
+//
+// A buffer of the default size is lock-free, as the free-running counters are
+// only used modulo 256 and a byte access is atomic on all targets. Any other
+// size needs the full 16-bit counters, which is not an atomic access on all
+// targets (such as AVR), so Put, Get and Used disable interrupts while they
+// access them.
 type RingBuffer struct {
-	rxbuffer [bufferSize]volatile.Register8
-	head     volatile.Register8
-	tail     volatile.Register8
+	buffer   [bufferSize]volatile.Register8
+	rxbuffer []volatile.Register8 // storage set with Resize, or nil for buffer
+	head     volatile.Register16
+	tail     volatile.Register16
 }
 
-// NewRingBuffer returns a new ring buffer.
+// NewRingBuffer returns a new ring buffer of the default size (128 bytes).
 func NewRingBuffer() *RingBuffer {
 	return &RingBuffer{}
 }
 
+// Resize replaces the storage of the buffer with one that can hold size bytes,
+// discarding any data in it. The size must be a power of two and no larger than
+// 32768, otherwise ErrInvalidConfig is returned. A size other than the default
+// is allocated on the heap, while the default storage embedded in the
+// RingBuffer stays in place, so it costs size bytes of RAM on top of the
+// 128 bytes every RingBuffer already uses.
+func (rb *RingBuffer) Resize(size int) error {
+	if size <= 0 || size > maxBufferSize || size&(size-1) != 0 {
+		return ErrInvalidConfig
+	}
+	if size == rb.Size() {
+		return nil
+	}
+	var buf []volatile.Register8
+	if size != bufferSize {
+		buf = make([]volatile.Register8, size)
+	}
+	mask := interrupt.Disable()
+	rb.rxbuffer = buf
+	rb.head.Set(0)
+	rb.tail.Set(0)
+	interrupt.Restore(mask)
+	return nil
+}
+
+// Size returns the number of bytes the buffer can hold.
+func (rb *RingBuffer) Size() int {
+	return len(rb.storage())
+}
+
+// storage returns the storage of the buffer: the default array, unless Resize
+// replaced it.
+func (rb *RingBuffer) storage() []volatile.Register8 {
+	if rb.rxbuffer == nil {
+		return rb.buffer[:]
+	}
+	return rb.rxbuffer
+}
+
 // Used returns how many bytes in buffer have been used.
-func (rb *RingBuffer) Used() uint8 {
-	return uint8(rb.head.Get() - rb.tail.Get())
+func (rb *RingBuffer) Used() uint16 {
+	if rb.rxbuffer == nil {
+		return uint16(uint8(rb.head.Get()) - uint8(rb.tail.Get()))
+	}
+	mask := interrupt.Disable()
+	used := rb.head.Get() - rb.tail.Get()
+	interrupt.Restore(mask)
+	return used
 }
 
 // Put stores a byte in the buffer. If the buffer is already
 // full, the method will return false.
 func (rb *RingBuffer) Put(val byte) bool {
-	if rb.Used() != bufferSize {
+	if rb.rxbuffer == nil {
+		if uint8(rb.head.Get())-uint8(rb.tail.Get()) != bufferSize {
+			rb.head.Set(rb.head.Get() + 1)
+			rb.buffer[rb.head.Get()%bufferSize].Set(val)
+			return true
+		}
+		return false
+	}
+	mask := interrupt.Disable()
+	buf := rb.storage()
+	ok := rb.head.Get()-rb.tail.Get() != uint16(len(buf))
+	if ok {
 		rb.head.Set(rb.head.Get() + 1)
-		rb.rxbuffer[rb.head.Get()%bufferSize].Set(val)
-		return true
+		buf[rb.head.Get()%uint16(len(buf))].Set(val)
 	}
-	return false
+	interrupt.Restore(mask)
+	return ok
 }
 
 // Get returns a byte from the buffer. If the buffer is empty,
 // the method will return a false as the second value.
 func (rb *RingBuffer) Get() (byte, bool) {
-	if rb.Used() != 0 {
+	if rb.rxbuffer == nil {
+		if uint8(rb.head.Get())-uint8(rb.tail.Get()) != 0 {
+			rb.tail.Set(rb.tail.Get() + 1)
+			return rb.buffer[rb.tail.Get()%bufferSize].Get(), true
+		}
+		return 0, false
+	}
+	mask := interrupt.Disable()
+	var val byte
+	ok := rb.head.Get()-rb.tail.Get() != 0
+	if ok {
 		rb.tail.Set(rb.tail.Get() + 1)
-		return rb.rxbuffer[rb.tail.Get()%bufferSize].Get(), true
+		buf := rb.storage()
+		val = buf[rb.tail.Get()%uint16(len(buf))].Get()
 	}
-	return 0, false
+	interrupt.Restore(mask)
+	return val, ok
 }
 
 // Clear resets the head and tail pointer to zero.
 func (rb *RingBuffer) Clear() {
+	mask := interrupt.Disable()
 	rb.head.Set(0)
 	rb.tail.Set(0)
+	interrupt.Restore(mask)
 }
@@ -21,6 +21,7 @@ var (
 	errI2CSignalStopTimeout  = errors.New("I2C timeout on signal stop")
 	errI2CAckExpected        = errors.New("I2C error: expected ACK not NACK")
 	errI2CBusError           = errors.New("I2C bus error")
+	errI2CBusStuck           = errors.New("I2C bus stuck: SDA is held low")
 )
 
 // WriteRegister transmits first the register and then the data to the
@@ -45,3 +46,22 @@ func (i2c I2C) WriteRegister(address uint8, register uint8, data []byte) error {
 func (i2c I2C) ReadRegister(address uint8, register uint8, data []byte) error {
 	return i2c.Tx(uint16(address), []byte{register}, data)
 }
+
+// I2CDevice is a single device at a fixed 7-bit address on an I2C bus. It
+// implements RegisterBus.
+type I2CDevice struct {
+	Bus     I2C
+	Address uint8
+}
+
+// ReadRegister reads len(data) bytes starting at the given register of this
+// device. See I2C.ReadRegister.
+func (d I2CDevice) ReadRegister(register uint8, data []byte) error {
+	return d.Bus.ReadRegister(d.Address, register, data)
+}
+
+// WriteRegister writes data starting at the given register of this device.
+// See I2C.WriteRegister.
+func (d I2CDevice) WriteRegister(register uint8, data []byte) error {
+	return d.Bus.WriteRegister(d.Address, register, data)
+}
@@ -10,6 +10,15 @@ var (
 	ErrNoPinChangeChannel = errors.New("machine: no channel available for pin interrupt")
 )
 
+// Common errors that may be returned by peripherals of any kind (SPI, I2C,
+// UART, etc.). Callers can compare against them with errors.Is.
+var (
+	ErrTimeout       = errors.New("machine: timeout")
+	ErrInvalidConfig = errors.New("machine: invalid configuration")
+	ErrBusInUse      = errors.New("machine: bus in use")
+	ErrNoPin         = errors.New("machine: no pin set")
+)
+
 type PinConfig struct {
 	Mode PinMode
 }
@@ -295,6 +295,7 @@ func (uart *UART) handleInterrupt(interrupt.Interrupt) {
 			// read up to 8 bits of data at a time
 			// TODO: 7, 9, and 10-bit support?
 			uart.Buffer.Put(uint8(uart.Bus.DATA.Get() & uint32(0xFF)))
+			uartRXNotify()
 		}
 		// if it was an IDLE status, clear the flag
 		if (stat & uint32(nxp.LPUART_STAT_IDLE)) != 0 {
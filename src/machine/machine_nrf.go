@@ -3,15 +3,28 @@
 package machine
 
 import (
+	"device/arm"
 	"device/nrf"
 	"errors"
+	"io"
 	"runtime/interrupt"
+	"runtime/volatile"
 )
 
 var (
 	ErrTxInvalidSliceSize = errors.New("SPI write and read slices must be same size")
+	ErrTxCanceled         = errors.New("SPI transfer canceled")
+	ErrNoErrorInfo        = errors.New("machine: peripheral has no error information")
+	ErrNotConfigured      = errors.New("machine: peripheral was never configured")
 )
 
+// interruptPriorityLow is the priority of most interrupts used by this
+// package. Only the upper bits of the priority are implemented: this is
+// priority 3 of 0-3 on the nrf51 and priority 6 of 0-7 on the nrf52, both of
+// which the SoftDevice leaves to the application, so these interrupts never
+// delay the BLE stack. See also interruptPriorityHigh.
+const interruptPriorityLow = 0xc0
+
 type PinMode uint8
 
 const (
@@ -19,6 +32,27 @@ const (
 	PinInputPullup   PinMode = PinInput | (nrf.GPIO_PIN_CNF_PULL_Pullup << nrf.GPIO_PIN_CNF_PULL_Pos)
 	PinInputPulldown PinMode = PinInput | (nrf.GPIO_PIN_CNF_PULL_Pulldown << nrf.GPIO_PIN_CNF_PULL_Pos)
 	PinOutput        PinMode = (nrf.GPIO_PIN_CNF_DIR_Output << nrf.GPIO_PIN_CNF_DIR_Pos) | (nrf.GPIO_PIN_CNF_INPUT_Disconnect << nrf.GPIO_PIN_CNF_INPUT_Pos)
+
+	// PinAnalog disconnects the digital input buffer of the pin, which avoids
+	// leakage current and noise when it is used as an analog input.
+	PinAnalog PinMode = (nrf.GPIO_PIN_CNF_DIR_Input << nrf.GPIO_PIN_CNF_DIR_Pos) | (nrf.GPIO_PIN_CNF_INPUT_Disconnect << nrf.GPIO_PIN_CNF_INPUT_Pos)
+
+	// PinOpenDrain is an output that only drives low: setting it high releases
+	// the line, which is then pulled high by an external pullup (or another
+	// device drives it). This allows wired-OR buses such as one-wire or I2C.
+	// PinOpenSource is the opposite: it only drives high. Both keep the input
+	// buffer connected, so Get returns the actual level of the line.
+	PinOpenDrain       PinMode = (nrf.GPIO_PIN_CNF_DIR_Output << nrf.GPIO_PIN_CNF_DIR_Pos) | (nrf.GPIO_PIN_CNF_INPUT_Connect << nrf.GPIO_PIN_CNF_INPUT_Pos) | (nrf.GPIO_PIN_CNF_DRIVE_S0D1 << pinModeDrivePos)
+	PinOpenDrainPullup PinMode = PinOpenDrain | (nrf.GPIO_PIN_CNF_PULL_Pullup << nrf.GPIO_PIN_CNF_PULL_Pos)
+	PinOpenSource      PinMode = (nrf.GPIO_PIN_CNF_DIR_Output << nrf.GPIO_PIN_CNF_DIR_Pos) | (nrf.GPIO_PIN_CNF_INPUT_Connect << nrf.GPIO_PIN_CNF_INPUT_Pos) | (nrf.GPIO_PIN_CNF_DRIVE_D0S1 << pinModeDrivePos)
+)
+
+// The DRIVE field of the PIN_CNF register doesn't fit in a PinMode at its
+// register position, so it is stored in the otherwise unused bits 4-6 of the
+// PinMode and moved in place by Configure.
+const (
+	pinModeDrivePos = 4
+	pinModeDriveMsk = 7 << pinModeDrivePos
 )
 
 type PinChange uint8
@@ -33,11 +67,78 @@ const (
 // Callbacks to be called for pins configured with SetInterrupt.
 var pinCallbacks [len(nrf.GPIOTE.CONFIG)]func(Pin)
 
-// Configure this pin with the given configuration.
+// Configure this pin with the given configuration. This also disables the
+// sense mechanism of the pin, see SetSense.
 func (p Pin) Configure(config PinConfig) {
-	cfg := config.Mode | nrf.GPIO_PIN_CNF_DRIVE_S0S1 | nrf.GPIO_PIN_CNF_SENSE_Disabled
+	drive := uint32(config.Mode&pinModeDriveMsk) >> pinModeDrivePos
+	cfg := uint32(config.Mode&^pinModeDriveMsk) |
+		(drive << nrf.GPIO_PIN_CNF_DRIVE_Pos) |
+		(nrf.GPIO_PIN_CNF_SENSE_Disabled << nrf.GPIO_PIN_CNF_SENSE_Pos)
+	port, pin := p.getPortPin()
+	port.PIN_CNF[pin].Set(cfg)
+}
+
+// GetConfig returns the current configuration of this pin, decoded from its
+// PIN_CNF register: direction, input buffer, pull resistor and drive mode. This
+// allows a library to borrow a pin and restore it afterwards:
+//
+//	saved := pin.GetConfig()
+//	// ... use the pin ...
+//	pin.Configure(saved)
+//
+// The output level and the SENSE field (used for wakeup from System OFF) are
+// not part of the configuration, so save those separately if needed. An
+// enabled peripheral that uses the pin overrides some of these settings, which
+// is not reflected here.
+func (p Pin) GetConfig() PinConfig {
+	port, pin := p.getPortPin()
+	cfg := port.PIN_CNF[pin].Get()
+	mode := PinMode(cfg & (nrf.GPIO_PIN_CNF_DIR_Msk | nrf.GPIO_PIN_CNF_INPUT_Msk | nrf.GPIO_PIN_CNF_PULL_Msk))
+	drive := (cfg & nrf.GPIO_PIN_CNF_DRIVE_Msk) >> nrf.GPIO_PIN_CNF_DRIVE_Pos
+	mode |= PinMode(drive << pinModeDrivePos)
+	return PinConfig{Mode: mode}
+}
+
+// PinSense is the level detected by the sense mechanism of a pin, see
+// Pin.SetSense.
+type PinSense uint8
+
+const (
+	PinSenseDisabled PinSense = nrf.GPIO_PIN_CNF_SENSE_Disabled
+	PinSenseHigh     PinSense = nrf.GPIO_PIN_CNF_SENSE_High
+	PinSenseLow      PinSense = nrf.GPIO_PIN_CNF_SENSE_Low
+)
+
+// SetSense enables the sense mechanism of this pin for the given level, or
+// disables it with PinSenseDisabled. A pin that is at its sense level wakes
+// the chip from System OFF and triggers the PORT event of the GPIOTE, which
+// can wake the CPU from sleep. Unlike the events of SetInterrupt, this works
+// without the high frequency clock, so it is the lowest power wake source.
+//
+// The sense mechanism needs the input buffer of the pin, so it is connected
+// when sense is enabled, even if the pin was configured with a mode that
+// disconnects it (such as PinOutput or PinAnalog). The direction and pull
+// resistor are kept. The buffer stays connected in all sleep modes until the
+// pin is configured again, which disables sense. A connected input buffer
+// only draws a significant current while the level of the pin is undefined,
+// so make sure that a pull resistor (internal or external) keeps a pin that
+// may float at a defined level.
+func (p Pin) SetSense(sense PinSense) {
 	port, pin := p.getPortPin()
-	port.PIN_CNF[pin].Set(uint32(cfg))
+	cfg := port.PIN_CNF[pin].Get() &^ nrf.GPIO_PIN_CNF_SENSE_Msk
+	if sense != PinSenseDisabled {
+		cfg &^= nrf.GPIO_PIN_CNF_INPUT_Msk
+		cfg |= nrf.GPIO_PIN_CNF_INPUT_Connect << nrf.GPIO_PIN_CNF_INPUT_Pos
+	}
+	port.PIN_CNF[pin].Set(cfg | uint32(sense)<<nrf.GPIO_PIN_CNF_SENSE_Pos)
+}
+
+// ConfigureOutput configures this pin as an output that starts at the given
+// level. The level is written to the OUT register before the pin is switched
+// to an output, so the pin never briefly drives the opposite level.
+func (p Pin) ConfigureOutput(high bool) {
+	p.Set(high)
+	p.Configure(PinConfig{Mode: PinOutput})
 }
 
 // Set the pin to high or low.
@@ -71,6 +172,39 @@ func (p Pin) Get() bool {
 	return (port.IN.Get()>>pin)&1 != 0
 }
 
+// ReadPort reads the input level of all pins in a GPIO port at once. Bit n of
+// the result is the level of pin n in the port, and pins not set in mask read
+// as zero. The nrf52833 and nrf52840 have two ports: port 0 holds P0.00-P0.31
+// and port 1 holds P1.00-P1.09 (nrf52833) or P1.00-P1.15 (nrf52840). Other
+// chips only have port 0.
+func ReadPort(port uint8, mask uint32) uint32 {
+	return getPort(port).IN.Get() & mask
+}
+
+// WritePort sets the output level of the pins in mask to the corresponding
+// bits in value, leaving the other pins of the port unchanged. All masked pins
+// change in a single register write, so there are no intermediate states on
+// the bus. This is a read-modify-write of the OUT register, so it must not race
+// with an interrupt that changes other pins of the same port.
+func WritePort(port uint8, value, mask uint32) {
+	p := getPort(port)
+	p.OUT.Set(p.OUT.Get()&^mask | value&mask)
+}
+
+// SetPins sets the output level of the pins in mask to the corresponding bits
+// in value, like WritePort, but through the OUTSET and OUTCLR registers: the
+// pins that go high change in one write and the pins that go low in the next,
+// so there is at most one intermediate state, lasting a single bus cycle.
+// Unlike WritePort it doesn't read the OUT register, so it is safe to use while
+// an interrupt changes other pins of the same port. A parallel bus that is
+// latched by a separate strobe pin, such as the data bus of an LCD, can be
+// written this way before pulsing the strobe.
+func SetPins(port uint8, value, mask uint32) {
+	p := getPort(port)
+	p.OUTSET.Set(value & mask)
+	p.OUTCLR.Set(^value & mask)
+}
+
 // SetInterrupt sets an interrupt to be executed when a particular pin changes
 // state. The pin should already be configured as an input, including a pull up
 // or down if no external pull is provided.
@@ -78,60 +212,95 @@ func (p Pin) Get() bool {
 // This call will replace a previously set callback on this pin. You can pass a
 // nil func to unset the pin change interrupt. If you do so, the change
 // parameter is ignored and can be set to any value (such as 0).
+//
+// The input buffer of the nrf GPIO pins has no configurable hysteresis or
+// filtering: a slowly changing or noisy signal, such as an open-collector
+// output with a weak pullup, can trigger the callback several times for one
+// edge. Use a stronger pullup to make the edges faster, or debounce in the
+// callback by ignoring changes that follow the previous one too closely.
+//
+// The GPIOTE channel connects the input buffer of the pin by itself, whatever
+// its configuration, and keeps it connected in sleep. However, it needs the
+// high frequency clock to detect edges, which costs current while the CPU
+// sleeps: for a wake source that is idle most of the time, SetSense uses
+// less.
 func (p Pin) SetInterrupt(change PinChange, callback func(Pin)) error {
-	// Some variables to easily check whether a channel was already configured
-	// as an event channel for the given pin.
-	// This is not just an optimization, this is requred: the datasheet says
-	// that configuring more than one channel for a given pin results in
+	// Look for a channel that was already configured by SetInterrupt for this
+	// pin. This is not just an optimization, this is requred: the datasheet
+	// says that configuring more than one channel for a given pin results in
 	// unpredictable behavior.
-	expectedConfigMask := uint32(nrf.GPIOTE_CONFIG_MODE_Msk | nrf.GPIOTE_CONFIG_PSEL_Msk)
-	expectedConfig := nrf.GPIOTE_CONFIG_MODE_Event<<nrf.GPIOTE_CONFIG_MODE_Pos | uint32(p)<<nrf.GPIOTE_CONFIG_PSEL_Pos
-
-	foundChannel := false
-	for i := range nrf.GPIOTE.CONFIG {
-		config := nrf.GPIOTE.CONFIG[i].Get()
-		if config == 0 || config&expectedConfigMask == expectedConfig {
-			// Found an empty GPIOTE channel or one that was already configured
-			// for this pin.
-			if callback == nil {
-				// Disable this channel.
-				nrf.GPIOTE.INTENCLR.Set(uint32(1 << uint(i)))
-				pinCallbacks[i] = nil
-				return nil
-			}
-			// Enable this channel with the given callback.
-			nrf.GPIOTE.INTENCLR.Set(uint32(1 << uint(i)))
-			nrf.GPIOTE.CONFIG[i].Set(nrf.GPIOTE_CONFIG_MODE_Event<<nrf.GPIOTE_CONFIG_MODE_Pos |
-				uint32(p)<<nrf.GPIOTE_CONFIG_PSEL_Pos |
-				uint32(change)<<nrf.GPIOTE_CONFIG_POLARITY_Pos)
-			pinCallbacks[i] = callback
-			nrf.GPIOTE.INTENSET.Set(uint32(1 << uint(i)))
-			foundChannel = true
+	channel := -1
+	for i := range pinCallbacks {
+		if pinCallbacks[i] != nil && GPIOTEChannel(i).Pin() == p {
+			channel = i
 			break
 		}
 	}
 
-	if !foundChannel {
-		return ErrNoPinChangeChannel
+	if callback == nil {
+		if channel >= 0 {
+			// Disable this channel.
+			pinCallbacks[channel] = nil
+			GPIOTEChannel(channel).Release()
+		}
+		return nil
+	}
+
+	if channel < 0 {
+		ch, err := AllocateGPIOTEChannel()
+		if err != nil {
+			return err
+		}
+		channel = int(ch)
 	}
 
-	// Set and enable the GPIOTE interrupt. It's not a problem if this happens
-	// more than once.
+	// Enable this channel with the given callback.
+	ch := GPIOTEChannel(channel)
+	nrf.GPIOTE.INTENCLR.Set(uint32(1 << uint(ch)))
+	ch.ConfigureEvent(p, change)
+	pinCallbacks[ch] = callback
+	nrf.GPIOTE.INTENSET.Set(uint32(1 << uint(ch)))
+
+	enableGPIOTEInterrupt()
+
+	// Everything was configured correctly.
+	return nil
+}
+
+// enableGPIOTEInterrupt sets and enables the GPIOTE interrupt, which handles
+// the pin change callbacks and the PORT event of UART.SuspendRX. It's not a
+// problem if this happens more than once.
+func enableGPIOTEInterrupt() {
 	interrupt.New(nrf.IRQ_GPIOTE, func(interrupt.Interrupt) {
 		for i := range nrf.GPIOTE.EVENTS_IN {
-			if nrf.GPIOTE.EVENTS_IN[i].Get() != 0 {
+			// Only handle channels with a callback: other channels may be in
+			// use by a different driver (such as CaptureEdges).
+			if pinCallbacks[i] != nil && nrf.GPIOTE.EVENTS_IN[i].Get() != 0 {
 				nrf.GPIOTE.EVENTS_IN[i].Set(0)
-				pin := Pin((nrf.GPIOTE.CONFIG[i].Get() & nrf.GPIOTE_CONFIG_PSEL_Msk) >> nrf.GPIOTE_CONFIG_PSEL_Pos)
-				pinCallbacks[i](pin)
+				pinCallbacks[i](GPIOTEChannel(i).Pin())
 			}
 		}
+		if uartRXSuspended.Get() != 0 && nrf.GPIOTE.EVENTS_PORT.Get() != 0 {
+			nrf.GPIOTE.EVENTS_PORT.Set(0)
+			handleUARTRXWake()
+		}
 	}).Enable()
-
-	// Everything was configured correctly.
-	return nil
 }
 
 // UART on the NRF.
+//
+// By default, writes block until every byte has been sent. With a non-zero
+// UARTConfig.TXBufferSize, writes are buffered instead: they return as soon as
+// the data is queued and the bytes are sent from the UART interrupt. Use Flush
+// to wait until all queued data has been sent, for example before sleeping.
+//
+// The UART interrupt has a higher priority than the other interrupts of this
+// package, so receiving and buffered sending keep going during SPI transfers,
+// including background transfers started with SPI.TxWithCallback, whose
+// interrupt can't delay it. A synchronous SPI.Tx busy-waits though: the bytes
+// are still received in the background, but a console goroutine only gets to
+// read them once Tx returns. Use TxWithCallback for long transfers, such as
+// flash writes, to keep an interactive console responsive.
 type UART struct {
 	Buffer *RingBuffer
 }
@@ -142,32 +311,87 @@ var (
 	NRF_UART0 = UART{Buffer: NewRingBuffer()}
 )
 
+// uartTXActive is set while buffered bytes are being sent from the interrupt.
+var uartTXActive volatile.Register8
+
+// uartTXBuffer is allocated once Configure was called with a TXBufferSize,
+// from then on writes go through it. It stays nil for unbuffered writes, so
+// that they don't cost any RAM.
+var uartTXBuffer *RingBuffer
+
 // Configure the UART.
-func (uart UART) Configure(config UARTConfig) {
+func (uart UART) Configure(config UARTConfig) error {
 	// Default baud rate to 115200.
 	if config.BaudRate == 0 {
 		config.BaudRate = 115200
 	}
 
+	if err := uart.SetFormat(config.Parity, config.StopBits); err != nil {
+		return err
+	}
+
+	if config.RXBufferSize != 0 {
+		if err := uart.Buffer.Resize(config.RXBufferSize); err != nil {
+			return err
+		}
+	}
+	if config.TXBufferSize != 0 {
+		uart.Flush()
+		buf := uartTXBuffer
+		if buf == nil {
+			buf = &RingBuffer{}
+		}
+		if err := buf.Resize(config.TXBufferSize); err != nil {
+			return err
+		}
+		uartTXBuffer = buf
+	}
+
 	uart.SetBaudRate(config.BaudRate)
 
 	// Set TX and RX pins
 	if config.TX == 0 && config.RX == 0 {
 		// Use default pins
-		uart.setPins(UART_TX_PIN, UART_RX_PIN)
-	} else {
-		uart.setPins(config.TX, config.RX)
+		config.TX, config.RX = UART_TX_PIN, UART_RX_PIN
 	}
+	uart.setPins(config.TX, config.RX)
+	uartRXPin = config.RX
 
 	nrf.UART0.ENABLE.Set(nrf.UART_ENABLE_ENABLE_Enabled)
 	nrf.UART0.TASKS_STARTTX.Set(1)
 	nrf.UART0.TASKS_STARTRX.Set(1)
 	nrf.UART0.INTENSET.Set(nrf.UART_INTENSET_RXDRDY_Msk)
 
-	// Enable RX IRQ.
+	// Enable RX IRQ. It has a higher priority than the other interrupts of
+	// this package, as the receive FIFO only holds 6 bytes.
 	intr := interrupt.New(nrf.IRQ_UART0, NRF_UART0.handleInterrupt)
-	intr.SetPriority(0xc0) // low priority
+	intr.SetPriority(interruptPriorityHigh)
 	intr.Enable()
+
+	return nil
+}
+
+// SetFormat sets the parity and the number of stop bits for the UART. The nrf
+// UART hardware only supports even parity. A stopBits value of 0 means the
+// default of one stop bit. Unsupported settings return ErrInvalidConfig.
+func (uart UART) SetFormat(parity UARTParity, stopBits uint8) error {
+	var conf uint32
+	switch parity {
+	case ParityNone:
+	case ParityEven:
+		conf |= nrf.UART_CONFIG_PARITY_Included << nrf.UART_CONFIG_PARITY_Pos
+	default:
+		return ErrInvalidConfig
+	}
+
+	stop, err := uartStopBits(stopBits)
+	if err != nil {
+		return err
+	}
+	conf |= stop
+
+	nrf.UART0.CONFIG.Set(conf)
+	return nil
 }
 
 // SetBaudRate sets the communication speed for the UART.
@@ -183,22 +407,158 @@ func (uart UART) SetBaudRate(br uint32) {
 	rate := uint32((uint64(br/400)*uint64(400*0xffffffff/16000000) + 0x800) & 0xffffff000)
 
 	nrf.UART0.BAUDRATE.Set(rate)
+	uartBaudRate = br
 }
 
 // WriteByte writes a byte of data to the UART.
 func (uart UART) WriteByte(c byte) error {
-	nrf.UART0.EVENTS_TXDRDY.Set(0)
-	nrf.UART0.TXD.Set(uint32(c))
-	for nrf.UART0.EVENTS_TXDRDY.Get() == 0 {
+	if uartTXBuffer == nil {
+		// Blocking write.
+		nrf.UART0.EVENTS_TXDRDY.Set(0)
+		nrf.UART0.TXD.Set(uint32(c))
+		for nrf.UART0.EVENTS_TXDRDY.Get() == 0 {
+		}
+		return nil
+	}
+
+	// Buffered write: wait until there is room in the buffer.
+	for !uartTXBuffer.Put(c) {
 	}
+	mask := interrupt.Disable()
+	if uartTXActive.Get() == 0 {
+		// Nothing is being sent, so start sending. The rest of the buffer is
+		// sent from the interrupt.
+		b, _ := uartTXBuffer.Get()
+		uartTXActive.Set(1)
+		nrf.UART0.EVENTS_TXDRDY.Set(0)
+		nrf.UART0.TXD.Set(uint32(b))
+		nrf.UART0.INTENSET.Set(nrf.UART_INTENSET_TXDRDY_Msk)
+	}
+	interrupt.Restore(mask)
 	return nil
 }
 
+// Flush waits until all buffered data has been sent. It returns immediately
+// if writes are not buffered.
+func (uart UART) Flush() {
+	for uartTXActive.Get() != 0 {
+	}
+}
+
+// State of the UART receiver, for SuspendRX.
+var (
+	uartRXPin       Pin
+	uartBaudRate    uint32
+	uartRXWake      func()
+	uartRXSuspended volatile.Register8
+)
+
+// SuspendRX stops the UART receiver until the host sends data again, so that
+// it doesn't keep the high frequency clock running (which draws far more
+// current than the sleeping CPU) while the device waits for a command.
+// Instead, the RX pin is watched by the low power sense mechanism of the GPIO:
+// the start bit of the next byte triggers the PORT event, which wakes the CPU
+// from sleep, restarts the receiver and then calls wake (if not nil) from the
+// interrupt. Sending keeps working while the receiver is suspended.
+//
+// The byte that wakes the receiver is always discarded: its start bit is over
+// by the time the receiver runs. To avoid receiving a garbled byte instead,
+// the receiver is only restarted once the line has been idle for the length of
+// a byte, which busy-waits in the interrupt for up to a few byte times. So the
+// host must first send a wake byte (of any value, 0x00 works well), wait for
+// at least two byte times, and then send the command. A host that can't do
+// that can repeat a command until it is answered.
+//
+// The RX pin is configured as an input with pullup while the receiver is
+// suspended, so that a disconnected host doesn't wake the device. The PORT
+// event is shared by all pins with sense enabled, so don't keep another one
+// sensing its level at the same time. This is for sleep in System ON; waking
+// from System OFF resets the chip.
+func (uart UART) SuspendRX(wake func()) {
+	if uartBaudRate == 0 || uartRXPin == NoPin {
+		return // not configured
+	}
+	uartRXWake = wake
+	nrf.UART0.TASKS_STOPRX.Set(1)
+	uartRXSuspended.Set(1)
+
+	// Sense a low level on the RX pin, which is idle high. The PORT event is
+	// generated when the sense condition starts to be met.
+	uartRXPin.Configure(PinConfig{Mode: PinInputPullup})
+	uartRXPin.SetSense(PinSenseLow)
+	nrf.GPIOTE.EVENTS_PORT.Set(0)
+	nrf.GPIOTE.INTENSET.Set(nrf.GPIOTE_INTENSET_PORT_Msk)
+	enableGPIOTEInterrupt()
+
+	mask := interrupt.Disable()
+	if uartRXSuspended.Get() != 0 && !uartRXPin.Get() {
+		// The host is sending already: wake up right away.
+		nrf.GPIOTE.EVENTS_PORT.Set(0)
+		handleUARTRXWake()
+	}
+	interrupt.Restore(mask)
+}
+
+// ResumeRX restarts the receiver after SuspendRX, without waiting for data
+// from the host. It does nothing when the receiver is not suspended.
+func (uart UART) ResumeRX() {
+	mask := interrupt.Disable()
+	defer interrupt.Restore(mask)
+	if uartRXSuspended.Get() != 0 {
+		stopUARTRXSense()
+		nrf.UART0.TASKS_STARTRX.Set(1)
+	}
+}
+
+// stopUARTRXSense disables the sense mechanism of the RX pin and hands the pin
+// back to the UART.
+func stopUARTRXSense() {
+	nrf.GPIOTE.INTENCLR.Set(nrf.GPIOTE_INTENCLR_PORT_Msk)
+	uartRXPin.Configure(PinConfig{Mode: PinInputPullup})
+	uartRXSuspended.Set(0)
+}
+
+// handleUARTRXWake restarts the receiver once the byte that woke it up has
+// been sent, and calls the wake callback of SuspendRX.
+func handleUARTRXWake() {
+	stopUARTRXSense()
+
+	// Wait until the line has been high for a byte (11 bit times, for a
+	// parity bit), or give up after 32 byte times: the line may be held low
+	// for a break.
+	bitTime := uint32(1e9) / uartBaudRate
+	step := bitTime / 2
+	idle := uint32(0)
+	for elapsed := uint32(0); idle < 11*bitTime && elapsed < 32*11*bitTime; elapsed += step {
+		if uartRXPin.Get() {
+			idle += step
+		} else {
+			idle = 0
+		}
+		delayNanoseconds(step)
+	}
+	nrf.UART0.EVENTS_RXDRDY.Set(0)
+	nrf.UART0.TASKS_STARTRX.Set(1)
+	if uartRXWake != nil {
+		uartRXWake()
+	}
+}
+
 func (uart *UART) handleInterrupt(interrupt.Interrupt) {
 	if nrf.UART0.EVENTS_RXDRDY.Get() != 0 {
 		uart.Receive(byte(nrf.UART0.RXD.Get()))
 		nrf.UART0.EVENTS_RXDRDY.Set(0x0)
 	}
+	if uartTXActive.Get() != 0 && nrf.UART0.EVENTS_TXDRDY.Get() != 0 {
+		nrf.UART0.EVENTS_TXDRDY.Set(0)
+		if b, ok := uartTXBuffer.Get(); ok {
+			nrf.UART0.TXD.Set(uint32(b))
+		} else {
+			// All data has been sent.
+			nrf.UART0.INTENCLR.Set(nrf.UART_INTENCLR_TXDRDY_Msk)
+			uartTXActive.Set(0)
+		}
+	}
 }
 
 // I2C on the NRF.
@@ -212,6 +572,13 @@ var (
 	I2C1 = I2C{Bus: nrf.TWI1}
 )
 
+// Errors returned by I2C.LastError.
+var (
+	ErrI2CAddressNACK = errors.New("I2C error: address not acknowledged")
+	ErrI2CDataNACK    = errors.New("I2C error: data not acknowledged")
+	ErrI2COverrun     = errors.New("I2C error: receive overrun")
+)
+
 // I2CConfig is used to store config info for I2C.
 type I2CConfig struct {
 	Frequency uint32
@@ -261,6 +628,7 @@ func (i2c I2C) Configure(config I2CConfig) {
 // bytes and stores them in r, and generates a stop condition on the bus.
 func (i2c I2C) Tx(addr uint16, w, r []byte) (err error) {
 	i2c.Bus.ADDRESS.Set(uint32(addr))
+	i2c.Bus.ERRORSRC.Set(i2c.Bus.ERRORSRC.Get()) // clear for LastError
 
 	if len(w) != 0 {
 		i2c.Bus.TASKS_STARTTX.Set(1) // start transmission for writing
@@ -294,6 +662,25 @@ cleanUp:
 	return
 }
 
+// LastError returns the cause of the last failed transfer, as recorded by the
+// TWI peripheral: ErrI2CAddressNACK when no device answered at the address,
+// ErrI2CDataNACK when the device refused a byte, or ErrI2COverrun when a
+// received byte was lost. It returns nil if the last transfer succeeded. Tx
+// only returns a generic bus error, so a bus manager can use this to tell a
+// missing device apart from a device that is busy.
+func (i2c I2C) LastError() error {
+	errorsrc := i2c.Bus.ERRORSRC.Get()
+	switch {
+	case errorsrc&nrf.TWI_ERRORSRC_ANACK_Msk != 0:
+		return ErrI2CAddressNACK
+	case errorsrc&nrf.TWI_ERRORSRC_DNACK_Msk != 0:
+		return ErrI2CDataNACK
+	case errorsrc&nrf.TWI_ERRORSRC_OVERRUN_Msk != 0:
+		return ErrI2COverrun
+	}
+	return nil
+}
+
 // signalStop sends a stop signal when writing or tells the I2C peripheral that
 // it must generate a stop condition after the next character is retrieved when
 // reading.
@@ -329,18 +716,105 @@ func (i2c I2C) readByte() (byte, error) {
 	return byte(i2c.Bus.RXD.Get()), nil
 }
 
+// Recover tries to release a stuck I2C bus, for example after a glitch left a
+// slave device in the middle of a transfer holding SDA low. It disables the
+// TWI peripheral, clocks SCL up to 9 times as a GPIO until the slave releases
+// SDA, generates a stop condition and then reconfigures the peripheral with
+// the given configuration. It returns an error if SDA is still held low.
+func (i2c I2C) Recover(config I2CConfig) error {
+	if config.SDA == 0 && config.SCL == 0 {
+		config.SDA = SDA_PIN
+		config.SCL = SCL_PIN
+	}
+
+	i2c.Bus.ENABLE.Set(nrf.TWI_ENABLE_ENABLE_Disabled)
+
+	config.SCL.configureOpenDrain()
+	config.SDA.configureOpenDrain()
+	i2cRecoverDelay()
+
+	// Clock out the rest of the byte the slave might still be sending.
+	for i := 0; i < 9 && !config.SDA.Get(); i++ {
+		config.SCL.Low()
+		i2cRecoverDelay()
+		config.SCL.High()
+		i2cRecoverDelay()
+	}
+
+	// Generate a stop condition: SDA goes high while SCL is high.
+	config.SCL.Low()
+	i2cRecoverDelay()
+	config.SDA.Low()
+	i2cRecoverDelay()
+	config.SCL.High()
+	i2cRecoverDelay()
+	config.SDA.High()
+	i2cRecoverDelay()
+	released := config.SDA.Get()
+
+	i2c.Configure(config)
+	if !released {
+		return errI2CBusStuck
+	}
+	return nil
+}
+
+// configureOpenDrain configures the pin as an open drain output with a pullup,
+// released (high) initially, for bit-banging I2C. The input buffer stays
+// connected, so the line level can still be read back with Get.
+func (p Pin) configureOpenDrain() {
+	p.High()
+	p.Configure(PinConfig{Mode: PinOpenDrainPullup})
+}
+
+// i2cRecoverDelay waits about half a clock period of a 100kHz I2C bus or a bit
+// longer, which is all the bus recovery procedure needs.
+func i2cRecoverDelay() {
+	for i := 0; i < 100; i++ {
+		arm.Asm("nop")
+	}
+}
+
 // SPI on the NRF.
+//
+// This uses the legacy SPI peripheral, which transfers one byte at a time
+// through the TXD/RXD registers instead of using EasyDMA. Therefore there is no
+// limit on the size of a single Tx call and no need for drivers to split their
+// buffers into chunks: any buffer size is transferred without extra overhead.
+//
+// For the same reason the buffers have no alignment requirement, and they may
+// be in flash as well as in RAM: a slice may start at any byte, such as an odd
+// offset within a struct, and is transferred as is without a bounce buffer.
+// (EasyDMA wouldn't need word alignment either, only buffers in RAM.) Data that
+// changes while it is transferred does change on the wire though, so buffers of
+// background transfers must be left alone until they are done, see
+// TxWithCallback.
 type SPI struct {
 	Bus *nrf.SPI_Type
 }
 
-// There are 2 SPI interfaces on the NRF5x.
+// There are 2 SPI interfaces on the NRF5x. Declaring them does not touch the
+// hardware: an instance stays disabled (and draws no current) until Configure
+// is called on it.
 var (
 	SPI0 = SPI{Bus: nrf.SPI0}
 	SPI1 = SPI{Bus: nrf.SPI1}
 )
 
 // SPIConfig is used to store config info for SPI.
+//
+// The SCK and SDO pins are always driven (to the clock idle level and low),
+// even while the bus is disabled, so they never float. The SDI pin is an input
+// that floats while no slave drives it. SDIMode selects its input mode, for
+// example PinInputPullup or PinInputPulldown to keep a shared bus quiet when it
+// is idle. The zero value is PinInput, without a pull resistor.
+//
+// SCK and SDO use the standard drive strength by default, which gives the
+// slowest edges the pins can make and is enough for short traces up to 8MHz.
+// Set HighDrive to drive them with the high drive strength (H0H1) instead, for
+// long wires or a high capacitive load. Slower edges ring less, for example
+// through a level shifter to a 5V device, so keep the standard drive unless
+// the edges are too slow for the frequency.
 type SPIConfig struct {
 	Frequency uint32
 	SCK       Pin
@@ -348,143 +822,1536 @@ type SPIConfig struct {
 	SDI       Pin
 	LSBFirst  bool
 	Mode      uint8
+	SDIMode   PinMode
+	HighDrive bool
 }
 
-// Configure is intended to setup the SPI interface.
-func (spi SPI) Configure(config SPIConfig) {
-	// Disable bus to configure it
-	spi.Bus.ENABLE.Set(nrf.SPI_ENABLE_ENABLE_Disabled)
+// Configure is intended to setup the SPI interface. Pins left at zero default
+// to the SPI0_*_PIN constants of the board, but only for SPI0: other instances
+// have no default pins and return ErrNoPin if any pin is left at zero. Set an
+// unused pin (such as SDI on a write-only bus) to NoPin explicitly.
+//
+// Calling Configure again with the same configuration does nothing, so it is
+// safe to call it defensively: the bus is only disabled and enabled again when
+// the frequency, mode, bit order, pins or drive strength change.
+func (spi SPI) Configure(config SPIConfig) error {
+	// Use the default pins for SPI0 if not set.
+	if spi.Bus == nrf.SPI0 {
+		if config.SCK == 0 {
+			config.SCK = SPI0_SCK_PIN
+		}
+		if config.SDO == 0 {
+			config.SDO = SPI0_SDO_PIN
+		}
+		if config.SDI == 0 {
+			config.SDI = SPI0_SDI_PIN
+		}
+	} else if config.SCK == 0 || config.SDO == 0 || config.SDI == 0 {
+		return ErrNoPin
+	}
 
-	// set frequency
-	var freq uint32
+	// Refuse pins that the chip reserves for another function or that another
+	// peripheral already uses, as they would silently not work.
+	for _, pin := range []Pin{config.SCK, config.SDO, config.SDI} {
+		if pin == NoPin {
+			continue
+		}
+		if err := pin.checkReserved(); err != nil {
+			return err
+		}
+		if err := spi.checkPinConflict(pin); err != nil {
+			return err
+		}
+	}
 
+	// set frequency
 	if config.Frequency == 0 {
 		config.Frequency = 4000000 // 4MHz
 	}
+	freq := spiFrequencyValue(config.Frequency)
 
-	switch {
-	case config.Frequency >= 8000000:
-		freq = nrf.SPI_FREQUENCY_FREQUENCY_M8
-	case config.Frequency >= 4000000:
-		freq = nrf.SPI_FREQUENCY_FREQUENCY_M4
-	case config.Frequency >= 2000000:
-		freq = nrf.SPI_FREQUENCY_FREQUENCY_M2
-	case config.Frequency >= 1000000:
-		freq = nrf.SPI_FREQUENCY_FREQUENCY_M1
-	case config.Frequency >= 500000:
-		freq = nrf.SPI_FREQUENCY_FREQUENCY_K500
-	case config.Frequency >= 250000:
-		freq = nrf.SPI_FREQUENCY_FREQUENCY_K250
-	default: // below 250kHz, default to the lowest speed available
-		freq = nrf.SPI_FREQUENCY_FREQUENCY_K125
+	conf := spiConfigValue(config.Mode, config.LSBFirst)
+
+	spiConfigs[spi.index()] = spiConfig{valid: true, config: config}
+
+	outMode := PinOutput
+	if config.HighDrive {
+		outMode |= nrf.GPIO_PIN_CNF_DRIVE_H0H1 << pinModeDrivePos
+	}
+
+	// Don't touch the bus when it is already configured this way: disabling
+	// and enabling it again could glitch the lines.
+	if spi.IsEnabled() && spi.Bus.FREQUENCY.Get() == freq && spi.Bus.CONFIG.Get() == conf {
+		sck, sdo, sdi := spi.getPins()
+		if sck == config.SCK && sdo == config.SDO && sdi == config.SDI &&
+			(sck == NoPin || sck.GetConfig().Mode == outMode) {
+			return nil
+		}
 	}
+
+	// Disable bus to configure it
+	spi.Bus.ENABLE.Set(nrf.SPI_ENABLE_ENABLE_Disabled)
 	spi.Bus.FREQUENCY.Set(freq)
+	spi.Bus.CONFIG.Set(conf)
+
+	// Configure the pins as GPIO as required by the datasheet, so that they
+	// keep a defined level when the bus is disabled. The SCK pin is set to its
+	// idle level first (low for CPOL=0, high for CPOL=1) to avoid a glitch on
+	// the clock line when the bus is enabled.
+	if config.SCK != NoPin {
+		config.SCK.Set(config.Mode == Mode2 || config.Mode == Mode3)
+		config.SCK.Configure(PinConfig{Mode: outMode})
+	}
+	if config.SDO != NoPin {
+		config.SDO.Low()
+		config.SDO.Configure(PinConfig{Mode: outMode})
+	}
+	if config.SDI != NoPin {
+		config.SDI.Configure(PinConfig{Mode: config.SDIMode})
+	}
 
+	// set pins
+	spi.setPins(config.SCK, config.SDO, config.SDI)
+
+	// Re-enable bus now that it is configured.
+	spi.Bus.ENABLE.Set(nrf.SPI_ENABLE_ENABLE_Enabled)
+
+	spiByteTime[spi.index()] = uint32(8e9 / uint64(spi.frequency()))
+
+	return nil
+}
+
+// Configuration of the SPI instances with the same index, for Restore: the
+// configuration of the last successful Configure call, with the defaults
+// filled in and updated by SetFrequency, SetMode and SetBitOrder.
+var spiConfigs [2]spiConfig
+
+type spiConfig struct {
+	valid  bool
+	config SPIConfig
+}
+
+// Restore configures the bus again with the configuration of the last
+// successful Configure call, including later changes made with SetFrequency,
+// SetMode and SetBitOrder, so that the caller doesn't need to keep the
+// SPIConfig around. Use it after Disable to power the bus up again, or after
+// ResetPeripherals. It returns ErrNotConfigured if Configure was never called.
+// Like Configure, it does nothing if the bus is still configured this way.
+//
+// The configuration is kept in RAM, so it doesn't survive a reset, including
+// the wake up from System OFF: call Configure after a reset.
+func (spi SPI) Restore() error {
+	cached := spiConfigs[spi.index()]
+	if !cached.valid {
+		return ErrNotConfigured
+	}
+	return spi.Configure(cached.config)
+}
+
+// PinConflictError is returned by SPI.Configure when a pin is already used by
+// another enabled serial peripheral. A pin can only be connected to a single
+// peripheral, so one of them would silently stop working.
+type PinConflictError struct {
+	Pin        Pin
+	Peripheral string // name of the peripheral using the pin, such as "I2C1"
+}
+
+func (e *PinConflictError) Error() string {
+	return "machine: pin already in use by " + e.Peripheral
+}
+
+// checkPinConflict returns a *PinConflictError if the pin is used by the SPI or
+// I2C peripheral in the other peripheral slot. The SPI and I2C peripherals with
+// the same number share their registers and only one of them can be enabled,
+// so the peripheral in the same slot is replaced by this one anyway.
+//
+// This reads the registers at runtime, so it also catches conflicts with
+// peripherals configured by another package.
+func (spi SPI) checkPinConflict(pin Pin) error {
+	otherSPI, otherI2C := SPI1, I2C1
+	if spi.index() == 1 {
+		otherSPI, otherI2C = SPI0, I2C0
+	}
+	switch otherSPI.Bus.ENABLE.Get() {
+	case nrf.SPI_ENABLE_ENABLE_Enabled:
+		sck, sdo, sdi := otherSPI.getPins()
+		if pin == sck || pin == sdo || pin == sdi {
+			name := "SPI1"
+			if otherSPI.index() == 0 {
+				name = "SPI0"
+			}
+			return &PinConflictError{Pin: pin, Peripheral: name}
+		}
+	case nrf.TWI_ENABLE_ENABLE_Enabled:
+		scl, sda := otherI2C.getPins()
+		if pin == scl || pin == sda {
+			name := "I2C1"
+			if otherI2C.Bus == nrf.TWI0 {
+				name = "I2C0"
+			}
+			return &PinConflictError{Pin: pin, Peripheral: name}
+		}
+	}
+	return nil
+}
+
+// spiConfigValue returns the CONFIG register value for the given mode and bit
+// order.
+func spiConfigValue(mode uint8, lsbFirst bool) uint32 {
 	var conf uint32
 
 	// set bit transfer order
-	if config.LSBFirst {
+	if lsbFirst {
 		conf = (nrf.SPI_CONFIG_ORDER_LsbFirst << nrf.SPI_CONFIG_ORDER_Pos)
 	}
 
 	// set mode
-	switch config.Mode {
-	case 0:
+	switch mode {
+	case Mode0:
 		conf &^= (nrf.SPI_CONFIG_CPOL_ActiveHigh << nrf.SPI_CONFIG_CPOL_Pos)
 		conf &^= (nrf.SPI_CONFIG_CPHA_Leading << nrf.SPI_CONFIG_CPHA_Pos)
-	case 1:
+	case Mode1:
 		conf &^= (nrf.SPI_CONFIG_CPOL_ActiveHigh << nrf.SPI_CONFIG_CPOL_Pos)
 		conf |= (nrf.SPI_CONFIG_CPHA_Trailing << nrf.SPI_CONFIG_CPHA_Pos)
-	case 2:
+	case Mode2:
 		conf |= (nrf.SPI_CONFIG_CPOL_ActiveLow << nrf.SPI_CONFIG_CPOL_Pos)
 		conf &^= (nrf.SPI_CONFIG_CPHA_Leading << nrf.SPI_CONFIG_CPHA_Pos)
-	case 3:
+	case Mode3:
 		conf |= (nrf.SPI_CONFIG_CPOL_ActiveLow << nrf.SPI_CONFIG_CPOL_Pos)
 		conf |= (nrf.SPI_CONFIG_CPHA_Trailing << nrf.SPI_CONFIG_CPHA_Pos)
 	default: // to mode
 		conf &^= (nrf.SPI_CONFIG_CPOL_ActiveHigh << nrf.SPI_CONFIG_CPOL_Pos)
 		conf &^= (nrf.SPI_CONFIG_CPHA_Leading << nrf.SPI_CONFIG_CPHA_Pos)
 	}
+	return conf
+}
+
+// applySettings changes the frequency, mode and bit order of the bus, only
+// writing the registers that change. Like SetBitOrder, it must only be called
+// when no transfer is in progress.
+func (spi SPI) applySettings(frequency uint32, mode uint8, lsbFirst bool) {
+	spi.applyFrequency(frequency)
+	conf := spiConfigValue(mode, lsbFirst)
+	if spi.Bus.CONFIG.Get() != conf {
+		spi.Bus.CONFIG.Set(conf)
+	}
+}
+
+// applyFrequency changes the frequency of the bus like applySettings, if it
+// differs.
+func (spi SPI) applyFrequency(frequency uint32) {
+	freq := spiFrequencyValue(frequency)
+	if spi.Bus.FREQUENCY.Get() != freq {
+		spi.Bus.FREQUENCY.Set(freq)
+		spiByteTime[spi.index()] = uint32(8e9 / uint64(spi.frequency()))
+	}
+}
+
+// SetBitOrder changes the bit order of the SPI bus without reconfiguring the
+// rest of the bus. This is cheaper than calling Configure again, which makes it
+// useful for switching between devices on a shared bus. It must only be called
+// when no transfer is in progress.
+func (spi SPI) SetBitOrder(lsbFirst bool) {
+	conf := spi.Bus.CONFIG.Get() &^ nrf.SPI_CONFIG_ORDER_Msk
+	if lsbFirst {
+		conf |= nrf.SPI_CONFIG_ORDER_LsbFirst << nrf.SPI_CONFIG_ORDER_Pos
+	}
 	spi.Bus.CONFIG.Set(conf)
+	spiConfigs[spi.index()].config.LSBFirst = lsbFirst
+}
 
-	// set pins
-	spi.setPins(config.SCK, config.SDO, config.SDI)
+// SetMode changes the clock polarity and phase of the SPI bus (Mode0 to Mode3)
+// without reconfiguring the rest of the bus, like SetBitOrder. It must only be
+// called when no transfer is in progress and no device is selected, as the
+// clock line moves to its new idle level right away.
+func (spi SPI) SetMode(mode uint8) {
+	spiConfigs[spi.index()].config.Mode = mode
+	const mask = nrf.SPI_CONFIG_CPOL_Msk | nrf.SPI_CONFIG_CPHA_Msk
+	conf := spi.Bus.CONFIG.Get()
+	newConf := conf&^mask | spiConfigValue(mode, false)&mask
+	if newConf == conf {
+		return
+	}
+	spi.Bus.CONFIG.Set(newConf)
 
-	// Re-enable bus now that it is configured.
-	spi.Bus.ENABLE.Set(nrf.SPI_ENABLE_ENABLE_Enabled)
+	// Keep the GPIO level of SCK in line with the new idle level, for when the
+	// bus is disabled.
+	if sck, _, _ := spi.getPins(); sck != NoPin {
+		sck.Set(mode == Mode2 || mode == Mode3)
+	}
 }
 
-// Transfer writes/reads a single byte using the SPI interface.
-func (spi SPI) Transfer(w byte) (byte, error) {
-	spi.Bus.TXD.Set(uint32(w))
-	for spi.Bus.EVENTS_READY.Get() == 0 {
+// spiFrequencyValue returns the FREQUENCY register value for the given
+// frequency in Hz. Frequencies are rounded down to the nearest supported one,
+// so anything above MaxFrequency is clamped to it.
+func spiFrequencyValue(hz uint32) uint32 {
+	switch {
+	case hz >= spiMaxFrequency:
+		return nrf.SPI_FREQUENCY_FREQUENCY_M8
+	case hz >= 4000000:
+		return nrf.SPI_FREQUENCY_FREQUENCY_M4
+	case hz >= 2000000:
+		return nrf.SPI_FREQUENCY_FREQUENCY_M2
+	case hz >= 1000000:
+		return nrf.SPI_FREQUENCY_FREQUENCY_M1
+	case hz >= 500000:
+		return nrf.SPI_FREQUENCY_FREQUENCY_K500
+	case hz >= 250000:
+		return nrf.SPI_FREQUENCY_FREQUENCY_K250
+	default: // below 250kHz, default to the lowest speed available
+		return nrf.SPI_FREQUENCY_FREQUENCY_K125
 	}
-	r := spi.Bus.RXD.Get()
-	spi.Bus.EVENTS_READY.Set(0)
+}
 
-	// TODO: handle SPI errors
-	return byte(r), nil
+// SetFrequency changes the SCK frequency of a configured bus without changing
+// the other settings, for example to initialize a device at a low frequency
+// and switch to a higher one afterwards. The frequency is rounded down as in
+// Configure. It must not be called during a transfer. It doesn't enable the
+// bus: a bus that is disabled (or released) stays so, with the new frequency.
+func (spi SPI) SetFrequency(hz uint32) {
+	spi.applyFrequency(hz)
+	spiConfigs[spi.index()].config.Frequency = hz
 }
 
-// Tx handles read/write operation for SPI interface. Since SPI is a syncronous write/read
-// interface, there must always be the same number of bytes written as bytes read.
-// The Tx method knows about this, and offers a few different ways of calling it.
-//
-// This form sends the bytes in tx buffer, putting the resulting bytes read into the rx buffer.
-// Note that the tx and rx buffers must be the same size:
-//
-// 		spi.Tx(tx, rx)
-//
-// This form sends the tx buffer, ignoring the result. Useful for sending "commands" that return zeros
-// until all the bytes in the command packet have been received:
-//
-// 		spi.Tx(tx, nil)
+// spiMaxFrequency is the highest SCK frequency of the SPI peripheral, in Hz.
+const spiMaxFrequency = 8000000
+
+// MaxFrequency returns the highest SCK frequency in Hz the SPI peripheral
+// supports, which is 8MHz on all nrf51 and nrf52 chips. Configure silently
+// clamps higher frequencies to this value, so a configuration ported from a
+// faster chip can be checked against it, and Frequency returns the frequency
+// that was actually configured. Whether the maximum works reliably still
+// depends on the board: long traces or wires may need a lower frequency.
+func (spi SPI) MaxFrequency() uint32 {
+	return spiMaxFrequency
+}
+
+// Frequency returns the SCK frequency in Hz the bus is currently configured
+// for, which may be lower than requested in SPIConfig because only a few
+// frequencies are supported.
+func (spi SPI) Frequency() uint32 {
+	return spi.frequency()
+}
+
+// frequency returns the SCK frequency in Hz the bus is currently configured
+// for. The FREQUENCY register values are multiples of 125kHz times 2^25.
+func (spi SPI) frequency() uint32 {
+	return (spi.Bus.FREQUENCY.Get() >> 25) * 125000
+}
+
+// EstimateTransferTime returns the time in nanoseconds it takes to transfer
+// the given number of bytes at the configured frequency, for example to pick
+// a frequency for a display refresh budget. A 240x240 display with 16 bits per
+// pixel needs 115200 bytes per frame, which takes about 115ms at 8MHz, so at
+// most about 8 frames per second.
 //
-// This form sends zeros, putting the result into the rx buffer. Good for reading a "result packet":
+// Tx keeps the clock running between bytes, so there is no per-byte or
+// per-chunk overhead on the nrf52. On the slower nrf51, the CPU cannot always
+// keep up at 8MHz, so the real time may be a bit longer. The value is in
+// nanoseconds as the machine package cannot use time.Duration; convert it with
+// time.Duration(ns).
+func (spi SPI) EstimateTransferTime(bytes int) int64 {
+	freq := spi.frequency()
+	if freq == 0 {
+		return 0
+	}
+	return int64(bytes) * 8 * 1e9 / int64(freq)
+}
+
+// LastError always returns ErrNoErrorInfo. It exists so that SPI and I2C
+// buses can be checked in the same way, see I2C.LastError. The SPI master of
+// the nrf has no error register: it can't detect a missing or misbehaving
+// device, and the errors it can detect, such as a bus that is in use, are
+// returned by the transfer methods themselves.
+func (spi SPI) LastError() error {
+	return ErrNoErrorInfo
+}
+
+// IsEnabled returns whether this SPI peripheral is enabled, which is the case
+// after Configure and until Disable. Drivers sharing a bus can use it to avoid
+// configuring a bus that another driver already set up.
 //
-// 		spi.Tx(nil, rx)
+// The ENABLE register is shared with the TWI (I2C) peripheral of the same
+// instance number. This only returns true if the instance is enabled as SPI,
+// not when it is in use as I2C0 or I2C1.
+func (spi SPI) IsEnabled() bool {
+	return spi.Bus.ENABLE.Get() == nrf.SPI_ENABLE_ENABLE_Enabled
+}
+
+// Disable turns off the SPI peripheral to save power, for example between
+// transfers in a low power design. The pins keep the levels set by Configure,
+// so the bus lines do not float. Call Restore (or Configure) to use the bus
+// again.
 //
-func (spi SPI) Tx(w, r []byte) error {
-	var err error
+// The SPI peripherals share their enable register with the TWI (I2C)
+// peripheral of the same instance number, so this also disables I2C0 or I2C1
+// if it was enabled.
+func (spi SPI) Disable() {
+	spi.Bus.ENABLE.Set(nrf.SPI_ENABLE_ENABLE_Disabled)
+}
 
-	switch {
-	case len(w) == 0:
-		// read only, so write zero and read a result.
-		for i := range r {
-			r[i], err = spi.Transfer(0)
-			if err != nil {
-				return err
-			}
+// Pins of the SPI instances while they are released with ReleaseBus.
+var spiReleased [2]struct {
+	released      bool
+	sck, sdo, sdi Pin
+	configs       [2]PinConfig // of sck and sdo
+}
+
+// ReleaseBus hands the bus over to another SPI master on the same lines: it
+// disables the bus, disconnects the peripheral from its pins and switches SCK
+// and SDO to inputs (high impedance), so that the other master can drive
+// them. Transfers return ErrBusInUse until AcquireBus is called. It returns
+// ErrBusInUse itself if a transfer is in progress.
+//
+// The lines float while neither master drives them, so the board should pull
+// the chip select lines high to keep the devices deselected; the chip select
+// pins of SPIDevice are GPIO outputs that stay driven, so release them
+// separately if the other master needs those too. Arbitration between the
+// masters is left to the application, for example with a request and grant
+// GPIO pair.
+func (spi SPI) ReleaseBus() error {
+	if !spi.acquire() {
+		return ErrBusInUse
+	}
+	spi.signalBusy(false) // the other master clocks from now on
+	state := &spiReleased[spi.index()]
+	state.released = true
+	state.sck, state.sdo, state.sdi = spi.getPins()
+	spi.Bus.ENABLE.Set(nrf.SPI_ENABLE_ENABLE_Disabled)
+	spi.disconnectPins()
+	// SDI is an input already.
+	for i, pin := range []Pin{state.sck, state.sdo} {
+		if pin != NoPin {
+			state.configs[i] = pin.GetConfig()
+			pin.Configure(PinConfig{Mode: PinInput})
 		}
+	}
+	return nil // the bus stays marked busy until AcquireBus
+}
+
+// AcquireBus takes the bus back after ReleaseBus, with the same pins and
+// settings as before. The other master must have stopped driving the lines
+// before it is called. It does nothing if the bus was not released.
+func (spi SPI) AcquireBus() {
+	state := &spiReleased[spi.index()]
+	if !state.released {
+		return
+	}
+	// Drive the lines to their idle levels before the peripheral takes over
+	// again, as in Configure, with the same drive strength.
+	if state.sck != NoPin {
+		state.sck.Set(spi.Bus.CONFIG.Get()&nrf.SPI_CONFIG_CPOL_Msk != 0)
+		state.sck.Configure(state.configs[0])
+	}
+	if state.sdo != NoPin {
+		state.sdo.Low()
+		state.sdo.Configure(state.configs[1])
+	}
+	spi.setPins(state.sck, state.sdo, state.sdi)
+	spi.Bus.ENABLE.Set(nrf.SPI_ENABLE_ENABLE_Enabled)
+	state.released = false
+	spi.release()
+}
+
+// SerialPeripheral identifies one of the serial peripherals that share a
+// peripheral slot, as returned by EnabledSerialPeripheral.
+type SerialPeripheral uint8
+
+// Serial peripherals in a shared peripheral slot. The EasyDMA variants (SPIM,
+// SPIS, TWIM and TWIS) are not used by this package, but may be enabled by
+// other code, such as the SoftDevice or C libraries.
+const (
+	SerialPeripheralNone    SerialPeripheral = iota // nothing is enabled
+	SerialPeripheralSPI                             // SPI master, as used by SPI0 and SPI1
+	SerialPeripheralTWI                             // I2C master, as used by I2C0 and I2C1
+	SerialPeripheralSPIM                            // SPI master with EasyDMA
+	SerialPeripheralSPIS                            // SPI slave with EasyDMA
+	SerialPeripheralTWIM                            // I2C master with EasyDMA
+	SerialPeripheralTWIS                            // I2C slave with EasyDMA
+	SerialPeripheralUnknown                         // an unknown value in the ENABLE register
+)
+
+// EnabledSerialPeripheral returns which of the peripherals in the peripheral
+// slot with the given instance number (0 or 1) is currently enabled. The
+// SPI/TWI peripherals (and their EasyDMA variants) with the same instance
+// number share their base address, and so also their registers, so only one of
+// them can be enabled at a time: configuring one replaces another. Code that
+// assigns buses at runtime can check this to avoid clobbering a bus that is in
+// use. SerialPeripheralNone is returned for other instance numbers.
+func EnabledSerialPeripheral(instance int) SerialPeripheral {
+	var enable uint32
+	switch instance {
+	case 0:
+		enable = nrf.SPI0.ENABLE.Get()
+	case 1:
+		enable = nrf.SPI1.ENABLE.Get()
+	default:
+		return SerialPeripheralNone
+	}
+	// The values of the ENABLE register are unique across the peripherals.
+	switch enable {
+	case 0:
+		return SerialPeripheralNone
+	case 1:
+		return SerialPeripheralSPI
+	case 2:
+		return SerialPeripheralSPIS
+	case 5:
+		return SerialPeripheralTWI
+	case 6:
+		return SerialPeripheralTWIM
+	case 7:
+		return SerialPeripheralSPIM
+	case 9:
+		return SerialPeripheralTWIS
+	default:
+		return SerialPeripheralUnknown
+	}
+}
+
+// SPIStatus is a snapshot of the state of an SPI instance, returned by Status
+// for health monitoring.
+type SPIStatus struct {
+	// Enabled is true if the bus is configured and enabled.
+	Enabled bool
+
+	// Busy is true while a transfer is in progress, including background
+	// transfers started with TxWithCallback or StartRepeat.
+	Busy bool
+
+	// Background is true while a transfer started with TxWithCallback or
+	// StartRepeat is running from the SPI interrupt.
+	Background bool
+
+	// Ready is the state of the EVENTS_READY register: a byte has been
+	// received and not yet read from RXD. This is normally only set briefly
+	// during a transfer. If it stays set while the bus is busy with a
+	// background transfer, its interrupt is not being handled.
+	Ready bool
+
+	// Transfers is the number of completed transfers, see Stats. If it
+	// doesn't change between two checks while Busy is set, the bus is stuck.
+	Transfers uint32
+}
+
+// Status returns the current state of the bus. The legacy SPI peripheral has
+// no error events, so a bus can only get stuck through its software state, for
+// example a background transfer whose interrupt is never handled. Reset
+// recovers from that.
+func (spi SPI) Status() SPIStatus {
+	idx := spi.index()
+	return SPIStatus{
+		Enabled:    spi.IsEnabled(),
+		Busy:       spiBusy[idx].Get() != 0,
+		Background: spiHandlers[idx] != nil,
+		Ready:      spi.Bus.EVENTS_READY.Get() != 0,
+		Transfers:  spiStats[idx].Transfers,
+	}
+}
+
+// Reset aborts any transfer that is in progress, including background
+// transfers (whose callbacks are not called), and flushes the TXD and RXD
+// buffers, leaving the bus idle with its configuration unchanged. It must not
+// be called while a synchronous transfer is in progress in another goroutine
+// or in an interrupt, as that transfer would wait forever.
+func (spi SPI) Reset() {
+	idx := spi.index()
+	spi.setInterruptHandler(nil)
+	spiAsync[idx] = spiAsyncState{}
+	spiRepeat[idx] = spiRepeatState{}
+
+	// Disabling the peripheral clears its TXD and RXD buffers. Leave the
+	// registers alone if the slot is not used as SPI, as they are shared with
+	// the TWI peripheral.
+	if spi.IsEnabled() {
+		spi.Bus.ENABLE.Set(nrf.SPI_ENABLE_ENABLE_Disabled)
+		spi.Bus.EVENTS_READY.Set(0)
+		spi.Bus.ENABLE.Set(nrf.SPI_ENABLE_ENABLE_Enabled)
+	}
+	spi.release()
+}
+
+// SPIStats holds counters of the activity of an SPI instance since boot (or
+// since the last ResetStats call), returned by Stats.
+type SPIStats struct {
+	// Transfers is the number of transfers (calls to Transfer, Tx, etc).
+	Transfers uint32
+
+	// Bytes is the number of bytes transferred.
+	Bytes uint64
+
+	// ActiveTime is the time in nanoseconds the bus was clocking data,
+	// calculated from the number of bytes and the configured frequency. The
+	// bus duty cycle is ActiveTime divided by the elapsed time.
+	ActiveTime uint64
+}
+
+var (
+	spiStats    [2]SPIStats
+	spiByteTime [2]uint32 // time in nanoseconds to transfer one byte
+)
+
+// countTransfer updates the statistics of this SPI instance for a transfer of
+// n bytes.
+func (spi SPI) countTransfer(n int) {
+	stats := &spiStats[spi.index()]
+	stats.Transfers++
+	stats.Bytes += uint64(n)
+	stats.ActiveTime += uint64(n) * uint64(spiByteTime[spi.index()])
+}
+
+// Stats returns the activity counters of this SPI instance, for example to
+// calculate the bus duty cycle for power profiling.
+func (spi SPI) Stats() SPIStats {
+	return spiStats[spi.index()]
+}
+
+// ResetStats resets the activity counters of this SPI instance.
+func (spi SPI) ResetStats() {
+	spiStats[spi.index()] = SPIStats{}
+}
+
+// Interrupt handlers of the SPI instances, indexed by instance number. The
+// interrupt is shared with the other peripherals (such as TWI) in the same
+// peripheral slot, but only one of them can be enabled at a time.
+var spiHandlers [2]func(SPI)
+
+// index returns the instance number of this SPI peripheral.
+func (spi SPI) index() int {
+	if spi.Bus == nrf.SPI1 {
+		return 1
+	}
+	return 0
+}
+
+// setInterruptHandler sets the function to be called on interrupts of this SPI
+// instance and enables the interrupt. Pass nil to remove the handler again. The
+// handler must clear the event that caused the interrupt, and events must be
+// enabled separately using the INTENSET register.
+func (spi SPI) setInterruptHandler(handler func(SPI)) {
+	spiHandlers[spi.index()] = handler
+	if handler == nil {
+		spi.Bus.INTENCLR.Set(nrf.SPI_INTENCLR_READY)
+		return
+	}
+	spi.enableInterrupt()
+}
+
+// handleSPIInterrupt dispatches the interrupt of a peripheral slot to the
+// handler of the SPI instance with the same number, if there is one.
+func handleSPIInterrupt(n int) {
+	handler := spiHandlers[n]
+	if handler == nil {
+		return
+	}
+	if n == 0 {
+		handler(SPI0)
+	} else {
+		handler(SPI1)
+	}
+}
+
+// spiBusy is set while a transfer is in progress on the SPI instance with the
+// same index, to detect a transfer started from an interrupt handler while
+// another one is running.
+var spiBusy [2]volatile.Register8
+
+// acquire marks the bus as busy and asserts its busy pin, if any. It returns
+// false if a transfer is already in progress, in which case the caller must not
+// touch the bus.
+func (spi SPI) acquire() bool {
+	busy := &spiBusy[spi.index()]
+	mask := interrupt.Disable()
+	ok := busy.Get() == 0
+	busy.Set(1)
+	interrupt.Restore(mask)
+	if ok {
+		spi.signalBusy(true)
+	}
+	return ok
+}
+
+// release marks the bus as idle again after acquire.
+func (spi SPI) release() {
+	spi.signalBusy(false)
+	spiBusy[spi.index()].Set(0)
+}
+
+// Busy pins of the SPI instances with the same index, set with SetBusyPin.
+var spiBusyPins [2]struct {
+	enabled    bool
+	pin        Pin
+	activeHigh bool
+}
+
+// SetBusyPin sets a pin that signals to another chip (such as an FPGA or a
+// coprocessor) that a transfer is in progress on this bus: it is at the active
+// level from just before the first clock edge of every transfer (including
+// background transfers) until just after its last one, and at the inactive
+// level otherwise. The pin is configured as an output and set to the inactive
+// level. Pass NoPin to stop signaling.
+//
+// The legacy SPI peripheral has no STARTED or END events that PPI could route
+// to a GPIOTE task (those are events of the SPIM), so the pin is driven by the
+// transfer code instead. It changes within a few cycles of the bus, at the
+// same points in every transfer, so it has no latency to speak of, only an
+// offset of well below 1µs.
+func (spi SPI) SetBusyPin(pin Pin, activeHigh bool) {
+	busyPin := &spiBusyPins[spi.index()]
+	busyPin.enabled = false
+	if pin == NoPin {
+		return
+	}
+	pin.ConfigureOutput(!activeHigh)
+	busyPin.pin = pin
+	busyPin.activeHigh = activeHigh
+	busyPin.enabled = true
+}
+
+// signalBusy sets the busy pin of the bus, if it has one, to the active or
+// inactive level.
+func (spi SPI) signalBusy(busy bool) {
+	if busyPin := &spiBusyPins[spi.index()]; busyPin.enabled {
+		busyPin.pin.Set(busy == busyPin.activeHigh)
+	}
+}
+
+// Transfer writes/reads a single byte using the SPI interface.
+func (spi SPI) Transfer(w byte) (byte, error) {
+	if !spi.acquire() {
+		return 0, ErrBusInUse
+	}
+	spi.Bus.TXD.Set(uint32(w))
+	for spi.Bus.EVENTS_READY.Get() == 0 {
+	}
+	r := spi.Bus.RXD.Get()
+	spi.Bus.EVENTS_READY.Set(0)
+	spi.release()
+	spi.countTransfer(1)
+
+	// TODO: handle SPI errors
+	return byte(r), nil
+}
+
+// Tx handles read/write operation for SPI interface. Since SPI is a syncronous write/read
+// interface, there must always be the same number of bytes written as bytes read.
+// The Tx method knows about this, and offers a few different ways of calling it.
+//
+// This form sends the bytes in tx buffer, putting the resulting bytes read into the rx buffer.
+// Note that the tx and rx buffers must be the same size:
+//
+// 		spi.Tx(tx, rx)
+//
+// This form sends the tx buffer, ignoring the result. Useful for sending "commands" that return zeros
+// until all the bytes in the command packet have been received:
+//
+// 		spi.Tx(tx, nil)
+//
+// This form sends zeros, putting the result into the rx buffer. Good for reading a "result packet":
+//
+// 		spi.Tx(nil, rx)
+//
+// To send or receive a fixed-size struct (for example a register map) without
+// copying it, the struct can be reinterpreted as a byte slice:
+//
+// 		var regs struct {
+// 			Ctrl   uint8
+// 			Status uint8
+// 			Value  uint16
+// 		}
+// 		buf := (*[unsafe.Sizeof(regs)]byte)(unsafe.Pointer(&regs))[:]
+// 		spi.Tx(nil, buf)
+//
+// The bytes are sent in memory order, which is little endian on the nrf, and
+// include any padding the compiler added between fields, so only use this
+// with structs whose layout matches the device: order fields so that none
+// needs padding, and swap multi-byte fields if the device is big endian. The
+// legacy SPI peripheral has no alignment requirements for the buffers.
+//
+// Tx busy-waits for the transfer to complete and doesn't depend on interrupts,
+// so it can also be called from an interrupt handler. It is not reentrant
+// though: if the interrupt fires while a transfer on the same bus is in
+// progress, the nested call returns ErrBusInUse without touching the bus
+// instead of corrupting both transfers. See TxFromISR.
+func (spi SPI) Tx(w, r []byte) error {
+	n := len(w)
+	switch {
+	case len(w) == 0:
+		// read only, so write zero and read a result.
+		n = len(r)
 	case len(r) == 0:
 		// write only
-		spi.Bus.TXD.Set(uint32(w[0]))
-		w = w[1:]
-		for _, b := range w {
-			spi.Bus.TXD.Set(uint32(b))
-			for spi.Bus.EVENTS_READY.Get() == 0 {
+	default:
+		// write/read
+		if len(w) != len(r) {
+			return ErrTxInvalidSliceSize
+		}
+	}
+	return spi.tx(w, r, n, 0)
+}
+
+// TxPad works like Tx, but the buffers may have different lengths: it
+// transfers as many bytes as the longer one, sending pad once w runs out and
+// discarding the bytes received once r is full. Devices differ in what they
+// expect on the data line while they are sending (many flash chips want 0xff,
+// most displays don't care and others want zeroes), so this allows picking
+// the padding per device on a shared bus, without reconfiguring it.
+func (spi SPI) TxPad(w, r []byte, pad byte) error {
+	n := len(w)
+	if len(r) > n {
+		n = len(r)
+	}
+	return spi.tx(w, r, n, pad)
+}
+
+// tx transfers n bytes, sending pad after the end of w and storing the
+// received bytes in r until it is full.
+func (spi SPI) tx(w, r []byte, n int, pad byte) error {
+	if n == 0 {
+		return nil
+	}
+	if !spi.acquire() {
+		return ErrBusInUse
+	}
+
+	// The TXD and RXD registers are double buffered. Write the next byte
+	// before waiting for the current one to finish, so that the clock keeps
+	// running without a gap between bytes.
+	spi.Bus.TXD.Set(uint32(txPadByte(w, 0, pad)))
+	for i := 0; i < n; i++ {
+		if i+1 < n {
+			spi.Bus.TXD.Set(uint32(txPadByte(w, i+1, pad)))
+		}
+		for spi.Bus.EVENTS_READY.Get() == 0 {
+		}
+		spi.Bus.EVENTS_READY.Set(0)
+		b := byte(spi.Bus.RXD.Get())
+		if i < len(r) {
+			r[i] = b
+		}
+	}
+	spi.release()
+
+	spi.countTransfer(n)
+	spiLogTransfer(spi, w, r)
+	spiCaptureTransfer(spi, w, r)
+	return nil
+}
+
+// TxFromISR is Tx for use in an interrupt handler, for example to read the data
+// register of a sensor from its data-ready interrupt. It returns ErrBusInUse if
+// the interrupt fired in the middle of another transfer on the same bus, so the
+// handler can defer the read (for example by setting a flag for the main loop)
+// rather than corrupting the interrupted transfer.
+//
+// Keep these transfers short: other interrupts of the same or lower priority
+// are delayed until it completes. If the device needs a chip select, make sure
+// the main loop doesn't have another device on the same bus selected.
+func (spi SPI) TxFromISR(w, r []byte) error {
+	return spi.Tx(w, r)
+}
+
+// spiProgressChunkSize is the number of bytes TxProgress transfers between two
+// calls of the progress callback.
+const spiProgressChunkSize = 255
+
+// TxProgress works like Tx, but calls progress after every chunk of 255 bytes
+// (and after the last, possibly shorter, chunk) with the number of bytes
+// transferred so far and the total number of bytes. This is useful to show
+// progress during very large transfers. The progress function may be nil.
+func (spi SPI) TxProgress(w, r []byte, progress func(done, total int)) error {
+	total := len(w)
+	if total == 0 {
+		total = len(r)
+	} else if len(r) != 0 && len(r) != total {
+		return ErrTxInvalidSliceSize
+	}
+	for done := 0; done < total; {
+		end := done + spiProgressChunkSize
+		if end > total {
+			end = total
+		}
+		var wc, rc []byte
+		if len(w) != 0 {
+			wc = w[done:end]
+		}
+		if len(r) != 0 {
+			rc = r[done:end]
+		}
+		if err := spi.Tx(wc, rc); err != nil {
+			return err
+		}
+		done = end
+		if progress != nil {
+			progress(done, total)
+		}
+	}
+	return nil
+}
+
+// TxCancel works like Tx, but stops early with ErrTxCanceled when the done
+// channel is closed, for example with ctx.Done() of a context.Context:
+//
+//	n, err := spi.TxCancel(ctx.Done(), w, r)
+//
+// The channel is checked before every chunk of up to 255 bytes, so a transfer
+// stops at most one chunk after the cancellation. It returns the number of
+// bytes transferred, which is exact after an abort as well: only whole chunks
+// are transferred, and bytes transferred before the abort are not undone. It
+// takes the done channel instead of a context, because the runtime depends on
+// this package, so the machine package can't import the context package. A
+// caller that needs the context error can return ctx.Err() on ErrTxCanceled.
+func (spi SPI) TxCancel(done <-chan struct{}, w, r []byte) (int, error) {
+	return spi.txAbortable(done, 0, w, r)
+}
+
+// TxTimeout works like TxCancel, but stops early with ErrTimeout once the
+// transfer has taken more than timeoutUS microseconds, and returns the number
+// of bytes transferred until then. The timeout is checked before every chunk,
+// so the transfer may take up to one chunk longer (255 bytes, about 2ms at
+// 1MHz). As the errors differ, a caller can tell a timeout from a
+// cancellation, for example to map them to context.DeadlineExceeded and
+// context.Canceled.
+func (spi SPI) TxTimeout(timeoutUS uint32, w, r []byte) (int, error) {
+	deadline := Ticks() + NanosecondsToTicks(int64(timeoutUS)*1000)
+	return spi.txAbortable(nil, deadline, w, r)
+}
+
+// txAbortable implements TxCancel and TxTimeout: it transfers w and r in
+// chunks, and stops before a chunk when done is closed or, if deadline is not
+// zero, when Ticks has passed the deadline. A nil done channel is never
+// closed.
+func (spi SPI) txAbortable(done <-chan struct{}, deadline uint64, w, r []byte) (int, error) {
+	total := len(w)
+	if total == 0 {
+		total = len(r)
+	} else if len(r) != 0 && len(r) != total {
+		return 0, ErrTxInvalidSliceSize
+	}
+	for start := 0; start < total; start += spiProgressChunkSize {
+		select {
+		case <-done:
+			return start, ErrTxCanceled
+		default:
+		}
+		if deadline != 0 && Ticks() > deadline {
+			return start, ErrTimeout
+		}
+		end := start + spiProgressChunkSize
+		if end > total {
+			end = total
+		}
+		var wc, rc []byte
+		if len(w) != 0 {
+			wc = w[start:end]
+		}
+		if len(r) != 0 {
+			rc = r[start:end]
+		}
+		if err := spi.Tx(wc, rc); err != nil {
+			return start, err
+		}
+	}
+	return total, nil
+}
+
+// TxUint32 writes the given 32-bit words, each split into 4 bytes in the given
+// byte order, ignoring the bytes read. The order is usually binary.BigEndian or
+// binary.LittleEndian from the encoding/binary package:
+//
+//	spi.TxUint32(words, binary.BigEndian)
+//
+// All words are sent in a single transfer without gaps in the clock, like
+// Tx16: every word is split into bytes while the previous one is being sent,
+// so there is no extra copy of the buffer.
+func (spi SPI) TxUint32(values []uint32, order interface{ PutUint32([]byte, uint32) }) error {
+	n := len(values) * 4
+	if n == 0 {
+		return nil
+	}
+	if !spi.acquire() {
+		return ErrBusInUse
+	}
+
+	// Same double buffered loop as in Tx. A word is encoded when its first
+	// byte is due, after all bytes of the previous word have been written.
+	var word [4]byte
+	order.PutUint32(word[:], values[0])
+	spi.Bus.TXD.Set(uint32(word[0]))
+	for i := 0; i < n; i++ {
+		if next := i + 1; next < n {
+			if next%4 == 0 {
+				order.PutUint32(word[:], values[next/4])
 			}
-			spi.Bus.EVENTS_READY.Set(0)
-			_ = spi.Bus.RXD.Get()
+			spi.Bus.TXD.Set(uint32(word[next%4]))
 		}
 		for spi.Bus.EVENTS_READY.Get() == 0 {
 		}
 		spi.Bus.EVENTS_READY.Set(0)
-		_ = spi.Bus.RXD.Get()
+		spi.Bus.RXD.Get()
+	}
+	spi.release()
 
-	default:
-		// write/read
-		if len(w) != len(r) {
-			return ErrTxInvalidSliceSize
+	spi.countTransfer(n)
+	return nil
+}
+
+// Write writes the data in p to the bus, ignoring the bytes read. This
+// implements io.Writer, which together with ReadFrom makes io.Copy(spi, r)
+// stream directly from r to the bus.
+func (spi SPI) Write(p []byte) (int, error) {
+	if err := spi.Tx(p, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Tx16 works like Tx, but transfers 16-bit words in big endian byte order (most
+// significant byte first). This is the byte order most displays expect for
+// RGB565 pixels, so a frame buffer of native uint16 values can be sent as-is
+// without swapping every pixel in software first. The words are split into
+// bytes while they are being sent, so there is no extra copy of the buffer.
+func (spi SPI) Tx16(w, r []uint16) error {
+	return spi.tx16(w, r, true)
+}
+
+// Tx16LE works like Tx16, but sends the least significant byte of every word
+// first.
+func (spi SPI) Tx16LE(w, r []uint16) error {
+	return spi.tx16(w, r, false)
+}
+
+// tx16 implements Tx16 and Tx16LE.
+func (spi SPI) tx16(w, r []uint16, bigEndian bool) error {
+	n := len(w)
+	switch {
+	case len(w) == 0:
+		n = len(r)
+	case len(r) != 0 && len(r) != len(w):
+		return ErrTxInvalidSliceSize
+	}
+	if n == 0 {
+		return nil
+	}
+	if !spi.acquire() {
+		return ErrBusInUse
+	}
+
+	// Byte i of the transfer is the high or low byte of word i/2. XOR-ing the
+	// shift with 8 swaps the bytes of every word for big endian.
+	swap := uint(0)
+	if bigEndian {
+		swap = 8
+	}
+	byteAt := func(i int) byte {
+		if i/2 >= len(w) {
+			return 0
+		}
+		return byte(w[i/2] >> (uint(i%2*8) ^ swap))
+	}
+
+	// Same double buffered loop as in Tx.
+	spi.Bus.TXD.Set(uint32(byteAt(0)))
+	for i := 0; i < n*2; i++ {
+		if i+1 < n*2 {
+			spi.Bus.TXD.Set(uint32(byteAt(i + 1)))
+		}
+		for spi.Bus.EVENTS_READY.Get() == 0 {
+		}
+		spi.Bus.EVENTS_READY.Set(0)
+		b := uint16(spi.Bus.RXD.Get()) & 0xff
+		if len(r) != 0 {
+			shift := uint(i%2*8) ^ swap
+			r[i/2] = r[i/2]&^(0xff<<shift) | b<<shift
 		}
+	}
+	spi.release()
+
+	spi.countTransfer(n * 2)
+	return nil
+}
+
+// spiReadFromChunkSize is the size of the buffer ReadFrom reads into before
+// sending the data, which is kept small as it is allocated on the stack.
+const spiReadFromChunkSize = 64
 
-		for i, b := range w {
-			r[i], err = spi.Transfer(b)
-			if err != nil {
-				return err
+// ReadFrom writes all data read from r to the bus until io.EOF, ignoring the
+// bytes read from the bus, and returns the number of bytes written. It reads
+// and sends the data in chunks of 64 bytes, so a large file or network stream
+// can be sent without buffering it in RAM. This implements io.ReaderFrom.
+//
+// The clock pauses while ReadFrom waits for the reader, so this is only
+// suitable for devices that don't mind gaps between bytes, which is true for
+// most SPI devices.
+func (spi SPI) ReadFrom(r io.Reader) (int64, error) {
+	var buf [spiReadFromChunkSize]byte
+	var total int64
+	for {
+		n, err := r.Read(buf[:])
+		if n > 0 {
+			if txErr := spi.Tx(buf[:n], nil); txErr != nil {
+				return total, txErr
 			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
 		}
 	}
+}
+
+// spiRepeatState is the state of a free-running transfer started with
+// StartRepeat.
+type spiRepeatState struct {
+	buf []byte
+	pos int
+}
+
+var spiRepeat [2]spiRepeatState
+
+// next returns the next byte to send, wrapping around at the end of the buffer.
+func (state *spiRepeatState) next() byte {
+	b := state.buf[state.pos]
+	state.pos++
+	if state.pos == len(state.buf) {
+		state.pos = 0
+	}
+	return b
+}
 
+// StartRepeat keeps the clock running by sending the bytes in buf over and
+// over again until StopRepeat is called, for devices that need a continuous
+// clock such as some audio codecs and shift register displays. Use a single
+// byte to clock out the same byte continuously. The buffer is read while it is
+// being sent, so changing its contents changes the data on the bus (for example
+// the next frame of a display) without stopping the clock.
+//
+// The bus is kept busy from an interrupt on every byte, so this takes a
+// significant part of the CPU time at high frequencies, and the clock may still
+// pause for a moment when another interrupt delays the SPI interrupt for
+// longer than a byte. Other transfers on the bus return ErrBusInUse until
+// StopRepeat is called.
+func (spi SPI) StartRepeat(buf []byte) error {
+	if len(buf) == 0 {
+		return ErrInvalidConfig
+	}
+	if !spi.acquire() {
+		return ErrBusInUse
+	}
+	spiRepeat[spi.index()] = spiRepeatState{buf: buf}
+	spi.Bus.EVENTS_READY.Set(0)
+	spi.setInterruptHandler(handleSPIRepeat)
+	spi.Bus.INTENSET.Set(nrf.SPI_INTENSET_READY)
+
+	// Fill both TXD and its buffer, so that there is always a byte waiting
+	// while the previous one is sent.
+	state := &spiRepeat[spi.index()]
+	spi.Bus.TXD.Set(uint32(state.next()))
+	spi.Bus.TXD.Set(uint32(state.next()))
 	return nil
 }
+
+// handleSPIRepeat is the interrupt handler of a free-running transfer: it
+// replaces every byte that was sent by the next one.
+func handleSPIRepeat(spi SPI) {
+	spi.Bus.EVENTS_READY.Set(0)
+	spi.Bus.RXD.Get() // the next byte is received once RXD has been read
+	spi.Bus.TXD.Set(uint32(spiRepeat[spi.index()].next()))
+}
+
+// StopRepeat stops a transfer started with StartRepeat, after the bytes that
+// are already queued have been sent. It does nothing if no such transfer is
+// running.
+func (spi SPI) StopRepeat() {
+	state := &spiRepeat[spi.index()]
+	if state.buf == nil {
+		return
+	}
+	spi.setInterruptHandler(nil)
+
+	// Every handled interrupt received one byte and queued the next, so there
+	// are always two bytes left to receive.
+	for i := 0; i < 2; i++ {
+		for spi.Bus.EVENTS_READY.Get() == 0 {
+		}
+		spi.Bus.EVENTS_READY.Set(0)
+		spi.Bus.RXD.Get()
+	}
+	*state = spiRepeatState{}
+	spi.release()
+}
+
+// spiAsyncState is the state of a transfer started with TxWithCallback.
+type spiAsyncState struct {
+	w, r []byte
+	n    int // number of bytes to transfer
+	sent int // number of bytes written to TXD
+	recv int // number of bytes read from RXD
+	done func(err error)
+}
+
+var spiAsync [2]spiAsyncState
+
+// TxWithCallback starts a transfer like Tx, but returns immediately and runs
+// the transfer from the SPI interrupt, so the CPU is free to do other work in
+// the meantime. When the transfer is complete, done is called from the
+// interrupt. The callback is passed with every transfer, so a bus manager can
+// dispatch completions to a different device for every transfer.
+//
+// The buffers must not be used until done is called. Starting a transfer
+// while another one is in progress returns ErrBusInUse, so starting the next
+// transfer from done is race free: the bus is released before done is called.
+// The interrupt is taken for every byte, so this is most useful at low
+// frequencies, where a synchronous Tx would waste a lot of time waiting.
+//
+// Buffers on the stack of the caller are safe to pass, even when the caller
+// returns or blocks before the transfer is complete. Goroutine stacks are
+// never moved or grown in TinyGo, and the buffers are stored for the
+// interrupt handler, so the compiler allocates a buffer that is passed here on
+// the heap instead of the stack anyway. No runtime check is needed for this.
+// What does corrupt a transfer is writing to w, or reading r, before done is
+// called: for example reusing one buffer for a second transfer, or leaving a
+// loop that fills the buffer again without waiting for done.
+func (spi SPI) TxWithCallback(w, r []byte, done func(err error)) error {
+	n := len(w)
+	switch {
+	case len(w) == 0:
+		n = len(r)
+	case len(r) != 0 && len(r) != len(w):
+		return ErrTxInvalidSliceSize
+	}
+	if n == 0 {
+		if done != nil {
+			done(nil)
+		}
+		return nil
+	}
+	if !spi.acquire() {
+		return ErrBusInUse
+	}
+	state := &spiAsync[spi.index()]
+	*state = spiAsyncState{w: w, r: r, n: n, done: done}
+	spi.Bus.EVENTS_READY.Set(0)
+	spi.setInterruptHandler(handleSPIAsync)
+	spi.Bus.INTENSET.Set(nrf.SPI_INTENSET_READY)
+
+	// Fill both TXD and its buffer, as in Tx.
+	spi.Bus.TXD.Set(uint32(txByte(w, 0)))
+	state.sent = 1
+	if n > 1 {
+		spi.Bus.TXD.Set(uint32(txByte(w, 1)))
+		state.sent = 2
+	}
+	return nil
+}
+
+// TxLowPower works like Tx, but sleeps the CPU (with WFE) while the transfer
+// runs from the SPI interrupt, instead of polling for every byte. The CPU only
+// wakes up for the interrupt of every byte, so at low bus frequencies (where
+// a byte takes many CPU cycles) this saves a lot of energy during long
+// transfers. At high frequencies the interrupt overhead makes it slower than
+// Tx, which is the better choice there.
+//
+// Other interrupts also wake the CPU; it goes back to sleep until the transfer
+// is complete. It must not be called from an interrupt, as the SPI interrupt
+// couldn't be taken.
+func (spi SPI) TxLowPower(w, r []byte) error {
+	var done volatile.Register8
+	var txErr error
+	err := spi.TxWithCallback(w, r, func(err error) {
+		txErr = err
+		done.Set(1)
+	})
+	if err != nil {
+		return err
+	}
+	for done.Get() == 0 {
+		// An interrupt between the check and WFE sets the event register, so
+		// WFE returns immediately and the transfer can't be missed.
+		arm.Asm("wfe")
+	}
+	return txErr
+}
+
+// handleSPIAsync is the interrupt handler of a transfer started with
+// TxWithCallback.
+func handleSPIAsync(spi SPI) {
+	state := &spiAsync[spi.index()]
+	spi.Bus.EVENTS_READY.Set(0)
+	b := byte(spi.Bus.RXD.Get())
+	if len(state.r) != 0 {
+		state.r[state.recv] = b
+	}
+	state.recv++
+	if state.sent < state.n {
+		spi.Bus.TXD.Set(uint32(txByte(state.w, state.sent)))
+		state.sent++
+	}
+	if state.recv < state.n {
+		return
+	}
+
+	// The transfer is complete. Release the bus before calling the callback,
+	// so that it can start the next transfer.
+	spi.setInterruptHandler(nil)
+	done := state.done
+	n := state.n
+	w, r := state.w, state.r
+	*state = spiAsyncState{}
+	spi.release()
+	spi.countTransfer(n)
+	spiLogTransfer(spi, w, r)
+	spiCaptureTransfer(spi, w, r)
+	if done != nil {
+		done(nil)
+	}
+}
+
+// TxParallel sends bufs[i] on spis[i] for every bus at the same time and
+// waits until all of them are done, for example to refresh two displays (or
+// the two halves of one display) on SPI0 and SPI1 in the time it takes to
+// refresh one. Received data is discarded. Both buses must be configured, and
+// there can be at most one buffer per SPI instance: ErrInvalidConfig is
+// returned if the lengths of spis and bufs differ or there are more than two,
+// and ErrBusInUse if a bus is busy or given twice.
+//
+// Instead of taking an interrupt per byte on each bus, as TxWithCallback
+// would, a single loop polls all buses and refills each one as soon as it is
+// ready, so that the clocks keep running with little or no gap between bytes,
+// as in Tx. When the CPU can't keep up with both buses at a high frequency,
+// bytes are only spaced further apart, and interrupts during the loop only
+// pause the clocks: the data is never corrupted. Chip selects are left to the
+// caller: assert them all before the call and deassert them after it returns.
+func TxParallel(spis []SPI, bufs [][]byte) error {
+	if len(spis) != len(bufs) || len(spis) > 2 {
+		return ErrInvalidConfig
+	}
+	var sent, recv [2]int
+	for i, spi := range spis {
+		if !spi.acquire() {
+			for _, spi := range spis[:i] {
+				spi.release()
+			}
+			return ErrBusInUse
+		}
+	}
+	// Fill both TXD and its buffer of every bus, as in Tx.
+	remaining := 0
+	for i, spi := range spis {
+		for sent[i] < len(bufs[i]) && sent[i] < 2 {
+			spi.Bus.TXD.Set(uint32(bufs[i][sent[i]]))
+			sent[i]++
+		}
+		if len(bufs[i]) != 0 {
+			remaining++
+		}
+	}
+	for remaining != 0 {
+		for i, spi := range spis {
+			if recv[i] == len(bufs[i]) || spi.Bus.EVENTS_READY.Get() == 0 {
+				continue
+			}
+			spi.Bus.EVENTS_READY.Set(0)
+			spi.Bus.RXD.Get()
+			recv[i]++
+			if sent[i] < len(bufs[i]) {
+				spi.Bus.TXD.Set(uint32(bufs[i][sent[i]]))
+				sent[i]++
+			}
+			if recv[i] == len(bufs[i]) {
+				remaining--
+			}
+		}
+	}
+	for i, spi := range spis {
+		spi.release()
+		if len(bufs[i]) != 0 {
+			spi.countTransfer(len(bufs[i]))
+			spiLogTransfer(spi, bufs[i], nil)
+			spiCaptureTransfer(spi, bufs[i], nil)
+		}
+	}
+	return nil
+}
+
+// txByte returns the byte at index i of the write buffer w, or zero if i is
+// past the end of w (or there is no write buffer).
+func txByte(w []byte, i int) byte {
+	return txPadByte(w, i, 0)
+}
+
+// txPadByte returns the byte at index i of the write buffer w, or pad if i is
+// past the end of w.
+func txPadByte(w []byte, i int, pad byte) byte {
+	if i >= len(w) {
+		return pad
+	}
+	return w[i]
+}
+
+// WriteThenRead writes cmd, discarding the bytes read meanwhile, and then
+// reads len(resp) bytes into resp while sending zeroes. Both phases are one
+// continuous transfer without a gap in the clock, which is what many flash
+// chips and sensors expect for a command followed by a response. Use
+// SPIDevice.WriteThenRead to also handle the chip select.
+func (spi SPI) WriteThenRead(cmd, resp []byte) error {
+	return spi.writeThenRead(cmd, 0, resp)
+}
+
+// WriteThenReadDummy works like WriteThenRead, but clocks the given number of
+// dummy cycles between the command and the response, as needed by the fast
+// read commands of many flash chips. For example a W25Q fast read (0x0B)
+// needs 8 dummy cycles after the address.
+//
+// The SPI peripheral can only transfer whole bytes, so dummyCycles must be a
+// multiple of 8, otherwise ErrInvalidConfig is returned. Chips with a dummy
+// period that is not a multiple of 8 cycles can't be used this way.
+func (spi SPI) WriteThenReadDummy(cmd []byte, dummyCycles int, resp []byte) error {
+	if dummyCycles < 0 || dummyCycles%8 != 0 {
+		return ErrInvalidConfig
+	}
+	return spi.writeThenRead(cmd, dummyCycles/8, resp)
+}
+
+// writeThenRead writes cmd followed by dummy zero bytes, discarding the bytes
+// read meanwhile, and then reads resp, in one continuous transfer.
+func (spi SPI) writeThenRead(cmd []byte, dummy int, resp []byte) error {
+	skip := len(cmd) + dummy
+	n := skip + len(resp)
+	if n == 0 {
+		return nil
+	}
+	if !spi.acquire() {
+		return ErrBusInUse
+	}
+
+	// Same double buffered loop as in Tx.
+	spi.Bus.TXD.Set(uint32(txByte(cmd, 0)))
+	for i := 0; i < n; i++ {
+		if i+1 < n {
+			spi.Bus.TXD.Set(uint32(txByte(cmd, i+1)))
+		}
+		for spi.Bus.EVENTS_READY.Get() == 0 {
+		}
+		spi.Bus.EVENTS_READY.Set(0)
+		b := byte(spi.Bus.RXD.Get())
+		if i >= skip {
+			resp[i-skip] = b
+		}
+	}
+	spi.release()
+
+	spi.countTransfer(n)
+	spiLogTransfer(spi, cmd, resp)
+	spiCaptureTransfer(spi, cmd, nil)
+	spiCaptureTransfer(spi, nil, resp)
+	return nil
+}
+
+// Probe checks whether a device is connected by sending cmd and then reading
+// len(expect) bytes of response, for example a JEDEC ID or WHO_AM_I register
+// read. It returns true if the response matches expect. When no device is
+// connected the response usually reads as all zeroes or all ones, so Probe
+// returns false instead of hanging.
+//
+// If the device needs a chip select, use SPIDevice.Probe instead.
+func (spi SPI) Probe(cmd, expect []byte) (bool, error) {
+	if err := spi.Tx(cmd, nil); err != nil {
+		return false, err
+	}
+	for _, b := range expect {
+		r, err := spi.Transfer(0)
+		if err != nil {
+			return false, err
+		}
+		if r != b {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// DeviceID returns the 64-bit unique device identifier that is programmed into
+// the FICR at the factory, in little endian byte order. This is a read-only
+// value that is different for every chip.
+func DeviceID() [8]byte {
+	var id [8]byte
+	lo := nrf.FICR.DEVICEID[0].Get()
+	hi := nrf.FICR.DEVICEID[1].Get()
+	for i := 0; i < 4; i++ {
+		id[i] = byte(lo >> (8 * uint(i)))
+		id[i+4] = byte(hi >> (8 * uint(i)))
+	}
+	return id
+}
+
+// SerialString returns DeviceID formatted as a serial number: 16 uppercase
+// hexadecimal digits, most significant first (DEVICEID[1] followed by
+// DEVICEID[0]), for example "1A2B3C4D5E6F7081". This is the same order as the
+// hardware ID reported by Zephyr, so serial numbers match across firmwares.
+// The ID of the nrf chips is 64 bits, not 96 as on some other chips.
+func SerialString() string {
+	const hexDigits = "0123456789ABCDEF"
+	id := DeviceID()
+	var s [16]byte
+	for i, b := range id {
+		s[14-2*i] = hexDigits[b>>4]
+		s[15-2*i] = hexDigits[b&0xf]
+	}
+	return string(s[:])
+}
+
+// DeviceAddr returns the 48-bit device address that is programmed into the
+// FICR at the factory, in little endian byte order. This is a read-only value
+// and is usually used as (random static) BLE address. Note that a BLE random
+// static address also needs the two most significant bits set.
+func DeviceAddr() [6]byte {
+	var addr [6]byte
+	lo := nrf.FICR.DEVICEADDR[0].Get()
+	hi := nrf.FICR.DEVICEADDR[1].Get()
+	for i := 0; i < 4; i++ {
+		addr[i] = byte(lo >> (8 * uint(i)))
+	}
+	addr[4] = byte(hi)
+	addr[5] = byte(hi >> 8)
+	return addr
+}
+
+// pselDisconnected is the value of a PSEL register of a peripheral signal that
+// is not connected to any pin, as after reset.
+const pselDisconnected = 0xffffffff
+
+// ResetPeripherals puts the peripherals used by this package back into a known
+// idle state without resetting the chip, for example between test cases on
+// hardware. It aborts SPI transfers (without calling their callbacks),
+// disables the SPI, I2C and PWM peripherals and disconnects them from their
+// pins, stops ADC captures and scans, and removes all pin change interrupts
+// set with SetInterrupt. Call Configure again to use a peripheral afterwards.
+//
+// The GPIO configuration of the pins is left unchanged, so the pins keep
+// their levels. UART0 is not touched either, as it is used for the console.
+// It must not be called while a transfer is in progress in another goroutine
+// or in an interrupt.
+func ResetPeripherals() {
+	// Stop the chip specific users of the SPI buses first.
+	resetPeripherals()
+
+	for _, spi := range []SPI{SPI0, SPI1} {
+		spi.Reset()
+		spi.Disable() // also disables the TWI in the same slot
+		spi.disconnectPins()
+	}
+	for _, i2c := range []I2C{I2C0, I2C1} {
+		i2c.disconnectPins()
+	}
+
+	for i := range pinCallbacks {
+		if pinCallbacks[i] != nil {
+			pinCallbacks[i] = nil
+			GPIOTEChannel(i).Release()
+		}
+	}
+}
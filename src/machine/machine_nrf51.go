@@ -3,7 +3,9 @@
 package machine
 
 import (
+	"device/arm"
 	"device/nrf"
+	"runtime/interrupt"
 )
 
 var (
@@ -19,28 +21,102 @@ func (p Pin) getPortPin() (*nrf.GPIO_Type, uint32) {
 	return nrf.GPIO, uint32(p)
 }
 
+// Get the GPIO peripheral for a port number. There is only one port.
+func getPort(port uint8) *nrf.GPIO_Type {
+	return nrf.GPIO
+}
+
+// The first PPI channel reserved by the SoftDevice (S110 reserves 8-15).
+const ppiSoftDeviceFirstChannel = 8
+
 func (uart UART) setPins(tx, rx Pin) {
 	nrf.UART0.PSELTXD.Set(uint32(tx))
 	nrf.UART0.PSELRXD.Set(uint32(rx))
 }
 
+// uartStopBits returns the UART CONFIG register bits for the given number of
+// stop bits. This chip only supports a single stop bit.
+func uartStopBits(stopBits uint8) (uint32, error) {
+	if stopBits > 1 {
+		return 0, ErrInvalidConfig
+	}
+	return 0, nil
+}
+
 func (i2c I2C) setPins(scl, sda Pin) {
 	i2c.Bus.PSELSCL.Set(uint32(scl))
 	i2c.Bus.PSELSDA.Set(uint32(sda))
 }
 
+// getPins returns the pins set with setPins.
+func (i2c I2C) getPins() (scl, sda Pin) {
+	return Pin(i2c.Bus.PSELSCL.Get()), Pin(i2c.Bus.PSELSDA.Get())
+}
+
+// disconnectPins disconnects the TWI peripheral from its pins.
+func (i2c I2C) disconnectPins() {
+	i2c.Bus.PSELSCL.Set(pselDisconnected)
+	i2c.Bus.PSELSDA.Set(pselDisconnected)
+}
+
 // SPI
 func (spi SPI) setPins(sck, sdo, sdi Pin) {
-	if sck == 0 {
-		sck = SPI0_SCK_PIN
-	}
-	if sdo == 0 {
-		sdo = SPI0_SDO_PIN
-	}
-	if sdi == 0 {
-		sdi = SPI0_SDI_PIN
-	}
 	spi.Bus.PSELSCK.Set(uint32(sck))
 	spi.Bus.PSELMOSI.Set(uint32(sdo))
 	spi.Bus.PSELMISO.Set(uint32(sdi))
 }
+
+// getPins returns the pins set with setPins.
+func (spi SPI) getPins() (sck, sdo, sdi Pin) {
+	return Pin(spi.Bus.PSELSCK.Get()), Pin(spi.Bus.PSELMOSI.Get()), Pin(spi.Bus.PSELMISO.Get())
+}
+
+// disconnectPins disconnects the SPI peripheral from its pins.
+func (spi SPI) disconnectPins() {
+	spi.Bus.PSELSCK.Set(pselDisconnected)
+	spi.Bus.PSELMOSI.Set(pselDisconnected)
+	spi.Bus.PSELMISO.Set(pselDisconnected)
+}
+
+// resetPeripherals resets the chip specific peripherals for ResetPeripherals.
+// This package has no PWM or ADC state on the nrf51.
+func resetPeripherals() {
+}
+
+// enableInterrupt enables the interrupt of the peripheral slot of this SPI
+// instance, which calls the handler set with setInterruptHandler.
+func (spi SPI) enableInterrupt() {
+	var intr interrupt.Interrupt
+	if spi.Bus == nrf.SPI0 {
+		intr = interrupt.New(nrf.IRQ_SPI0_TWI0, func(interrupt.Interrupt) {
+			handleSPIInterrupt(0)
+		})
+	} else {
+		intr = interrupt.New(nrf.IRQ_SPI1_TWI1, func(interrupt.Interrupt) {
+			handleSPIInterrupt(1)
+		})
+	}
+	intr.SetPriority(interruptPriorityLow)
+	intr.Enable()
+}
+
+// delayNanoseconds waits at least the given number of nanoseconds. The nrf51
+// has no cycle counter, so this is a busy loop that takes at least 4 cycles
+// (250ns at 16MHz) per iteration.
+func delayNanoseconds(ns uint32) {
+	for i := ns/250 + 1; i != 0; i-- {
+		arm.Asm("nop")
+	}
+}
+
+// bootloaderAddress returns the start address of the bootloader as recorded in
+// the UICR, or 0xffffffff when there is none.
+func bootloaderAddress() uint32 {
+	return nrf.UICR.BOOTLOADERADDR.Get()
+}
+
+// checkReserved returns an error if this pin can't be used as GPIO. The nrf51
+// has no NFC or configurable reset pin, so all pins can be used.
+func (p Pin) checkReserved() error {
+	return nil
+}
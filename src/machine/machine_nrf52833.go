@@ -0,0 +1,210 @@
+// +build nrf52833
+
+package machine
+
+import (
+	"device/nrf"
+	"runtime/interrupt"
+	"unsafe"
+)
+
+var (
+	UART0 = NRF_UART0
+)
+
+func CPUFrequency() uint32 {
+	return 64000000
+}
+
+// Hardware pins
+const (
+	P0_00 Pin = 0
+	P0_01 Pin = 1
+	P0_02 Pin = 2
+	P0_03 Pin = 3
+	P0_04 Pin = 4
+	P0_05 Pin = 5
+	P0_06 Pin = 6
+	P0_07 Pin = 7
+	P0_08 Pin = 8
+	P0_09 Pin = 9
+	P0_10 Pin = 10
+	P0_11 Pin = 11
+	P0_12 Pin = 12
+	P0_13 Pin = 13
+	P0_14 Pin = 14
+	P0_15 Pin = 15
+	P0_16 Pin = 16
+	P0_17 Pin = 17
+	P0_18 Pin = 18
+	P0_19 Pin = 19
+	P0_20 Pin = 20
+	P0_21 Pin = 21
+	P0_22 Pin = 22
+	P0_23 Pin = 23
+	P0_24 Pin = 24
+	P0_25 Pin = 25
+	P0_26 Pin = 26
+	P0_27 Pin = 27
+	P0_28 Pin = 28
+	P0_29 Pin = 29
+	P0_30 Pin = 30
+	P0_31 Pin = 31
+	P1_00 Pin = 32
+	P1_01 Pin = 33
+	P1_02 Pin = 34
+	P1_03 Pin = 35
+	P1_04 Pin = 36
+	P1_05 Pin = 37
+	P1_06 Pin = 38
+	P1_07 Pin = 39
+	P1_08 Pin = 40
+	P1_09 Pin = 41
+)
+
+// Get peripheral and pin number for this GPIO pin.
+func (p Pin) getPortPin() (*nrf.GPIO_Type, uint32) {
+	if p >= 32 {
+		return nrf.P1, uint32(p - 32)
+	} else {
+		return nrf.P0, uint32(p)
+	}
+}
+
+// Get the GPIO peripheral for a port number (P0 or P1).
+func getPort(port uint8) *nrf.GPIO_Type {
+	if port == 1 {
+		return nrf.P1
+	}
+	return nrf.P0
+}
+
+// The first PPI channel reserved by the SoftDevice (channels 17-19).
+const ppiSoftDeviceFirstChannel = 17
+
+func (uart UART) setPins(tx, rx Pin) {
+	nrf.UART0.PSEL.TXD.Set(uint32(tx))
+	nrf.UART0.PSEL.RXD.Set(uint32(rx))
+}
+
+// uartStopBits returns the UART CONFIG register bits for the given number of
+// stop bits. The nrf52833 supports one or two stop bits.
+func uartStopBits(stopBits uint8) (uint32, error) {
+	switch stopBits {
+	case 0, 1:
+		return nrf.UART_CONFIG_STOP_One << nrf.UART_CONFIG_STOP_Pos, nil
+	case 2:
+		return nrf.UART_CONFIG_STOP_Two << nrf.UART_CONFIG_STOP_Pos, nil
+	default:
+		return 0, ErrInvalidConfig
+	}
+}
+
+func (i2c I2C) setPins(scl, sda Pin) {
+	i2c.Bus.PSEL.SCL.Set(uint32(scl))
+	i2c.Bus.PSEL.SDA.Set(uint32(sda))
+}
+
+// getPins returns the pins set with setPins.
+func (i2c I2C) getPins() (scl, sda Pin) {
+	return Pin(i2c.Bus.PSEL.SCL.Get()), Pin(i2c.Bus.PSEL.SDA.Get())
+}
+
+// disconnectPins disconnects the TWI peripheral from its pins.
+func (i2c I2C) disconnectPins() {
+	i2c.Bus.PSEL.SCL.Set(pselDisconnected)
+	i2c.Bus.PSEL.SDA.Set(pselDisconnected)
+}
+
+// SPI
+func (spi SPI) setPins(sck, sdo, sdi Pin) {
+	spi.Bus.PSEL.SCK.Set(uint32(sck))
+	spi.Bus.PSEL.MOSI.Set(uint32(sdo))
+	spi.Bus.PSEL.MISO.Set(uint32(sdi))
+}
+
+// getPins returns the pins set with setPins.
+func (spi SPI) getPins() (sck, sdo, sdi Pin) {
+	return Pin(spi.Bus.PSEL.SCK.Get()), Pin(spi.Bus.PSEL.MOSI.Get()), Pin(spi.Bus.PSEL.MISO.Get())
+}
+
+// disconnectPins disconnects the SPI peripheral from its pins.
+func (spi SPI) disconnectPins() {
+	spi.Bus.PSEL.SCK.Set(pselDisconnected)
+	spi.Bus.PSEL.MOSI.Set(pselDisconnected)
+	spi.Bus.PSEL.MISO.Set(pselDisconnected)
+}
+
+// enableInterrupt enables the interrupt of the peripheral slot of this SPI
+// instance, which calls the handler set with setInterruptHandler.
+func (spi SPI) enableInterrupt() {
+	var intr interrupt.Interrupt
+	if spi.Bus == nrf.SPI0 {
+		intr = interrupt.New(nrf.IRQ_SPIM0_SPIS0_TWIM0_TWIS0_SPI0_TWI0, func(interrupt.Interrupt) {
+			handleSPIInterrupt(0)
+		})
+	} else {
+		intr = interrupt.New(nrf.IRQ_SPIM1_SPIS1_TWIM1_TWIS1_SPI1_TWI1, func(interrupt.Interrupt) {
+			handleSPIInterrupt(1)
+		})
+	}
+	intr.SetPriority(interruptPriorityLow)
+	intr.Enable()
+}
+
+// InitADC initializes the registers needed for ADC.
+func InitADC() {
+	return // no specific setup on nrf52833 machine.
+}
+
+// Configure configures an ADC pin to be able to read analog data.
+func (a ADC) Configure() error {
+	a.Pin.Configure(PinConfig{Mode: PinAnalog})
+	return nil
+}
+
+// PWM
+var (
+	pwmChannelPins     = [4]uint32{0xFFFFFFFF, 0xFFFFFFFF, 0xFFFFFFFF, 0xFFFFFFFF}
+	pwms               = [4]*nrf.PWM_Type{nrf.PWM0, nrf.PWM1, nrf.PWM2, nrf.PWM3}
+	pwmChannelSequence [4]uint16
+)
+
+// InitPWM initializes the registers needed for PWM.
+func InitPWM() {
+	return
+}
+
+// Configure configures a PWM pin for output.
+func (pwm PWM) Configure() {
+}
+
+// Set turns on the duty cycle for a PWM pin using the provided value.
+func (pwm PWM) Set(value uint16) {
+	for i := 0; i < 4; i++ {
+		if pwmChannelPins[i] == 0xFFFFFFFF || pwmChannelPins[i] == uint32(pwm.Pin) {
+			pwmChannelPins[i] = uint32(pwm.Pin)
+			pwmChannelSequence[i] = (value >> 2) | 0x8000 // set bit 15 to invert polarity
+
+			p := pwms[i]
+
+			p.PSEL.OUT[0].Set(uint32(pwm.Pin))
+			p.PSEL.OUT[1].Set(uint32(pwm.Pin))
+			p.PSEL.OUT[2].Set(uint32(pwm.Pin))
+			p.PSEL.OUT[3].Set(uint32(pwm.Pin))
+			p.ENABLE.Set(nrf.PWM_ENABLE_ENABLE_Enabled << nrf.PWM_ENABLE_ENABLE_Pos)
+			p.PRESCALER.Set(nrf.PWM_PRESCALER_PRESCALER_DIV_2)
+			p.MODE.Set(nrf.PWM_MODE_UPDOWN_Up)
+			p.COUNTERTOP.Set(16384) // frequency
+			p.LOOP.Set(0)
+			p.DECODER.Set((nrf.PWM_DECODER_LOAD_Common << nrf.PWM_DECODER_LOAD_Pos) | (nrf.PWM_DECODER_MODE_RefreshCount << nrf.PWM_DECODER_MODE_Pos))
+			p.SEQ[0].PTR.Set(uint32(uintptr(unsafe.Pointer(&pwmChannelSequence[i]))))
+			p.SEQ[0].CNT.Set(1)
+			p.SEQ[0].REFRESH.Set(1)
+			p.SEQ[0].ENDDELAY.Set(0)
+			p.TASKS_SEQSTART[0].Set(1)
+
+			break
+		}
+	}
+}
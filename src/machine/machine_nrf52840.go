@@ -4,6 +4,7 @@ package machine
 
 import (
 	"device/nrf"
+	"runtime/interrupt"
 	"unsafe"
 )
 
@@ -72,130 +73,96 @@ func (p Pin) getPortPin() (*nrf.GPIO_Type, uint32) {
 	}
 }
 
+// Get the GPIO peripheral for a port number (P0 or P1).
+func getPort(port uint8) *nrf.GPIO_Type {
+	if port == 1 {
+		return nrf.P1
+	}
+	return nrf.P0
+}
+
+// The first PPI channel reserved by the SoftDevice (channels 17-19).
+const ppiSoftDeviceFirstChannel = 17
+
 func (uart UART) setPins(tx, rx Pin) {
 	nrf.UART0.PSEL.TXD.Set(uint32(tx))
 	nrf.UART0.PSEL.RXD.Set(uint32(rx))
 }
 
+// uartStopBits returns the UART CONFIG register bits for the given number of
+// stop bits. The nrf52840 supports one or two stop bits.
+func uartStopBits(stopBits uint8) (uint32, error) {
+	switch stopBits {
+	case 0, 1:
+		return nrf.UART_CONFIG_STOP_One << nrf.UART_CONFIG_STOP_Pos, nil
+	case 2:
+		return nrf.UART_CONFIG_STOP_Two << nrf.UART_CONFIG_STOP_Pos, nil
+	default:
+		return 0, ErrInvalidConfig
+	}
+}
+
 func (i2c I2C) setPins(scl, sda Pin) {
 	i2c.Bus.PSEL.SCL.Set(uint32(scl))
 	i2c.Bus.PSEL.SDA.Set(uint32(sda))
 }
 
+// getPins returns the pins set with setPins.
+func (i2c I2C) getPins() (scl, sda Pin) {
+	return Pin(i2c.Bus.PSEL.SCL.Get()), Pin(i2c.Bus.PSEL.SDA.Get())
+}
+
+// disconnectPins disconnects the TWI peripheral from its pins.
+func (i2c I2C) disconnectPins() {
+	i2c.Bus.PSEL.SCL.Set(pselDisconnected)
+	i2c.Bus.PSEL.SDA.Set(pselDisconnected)
+}
+
 // SPI
 func (spi SPI) setPins(sck, sdo, sdi Pin) {
-	if sck == 0 {
-		sck = SPI0_SCK_PIN
-	}
-	if sdo == 0 {
-		sdo = SPI0_SDO_PIN
-	}
-	if sdi == 0 {
-		sdi = SPI0_SDI_PIN
-	}
 	spi.Bus.PSEL.SCK.Set(uint32(sck))
 	spi.Bus.PSEL.MOSI.Set(uint32(sdo))
 	spi.Bus.PSEL.MISO.Set(uint32(sdi))
 }
 
-// InitADC initializes the registers needed for ADC.
-func InitADC() {
-	return // no specific setup on nrf52840 machine.
+// getPins returns the pins set with setPins.
+func (spi SPI) getPins() (sck, sdo, sdi Pin) {
+	return Pin(spi.Bus.PSEL.SCK.Get()), Pin(spi.Bus.PSEL.MOSI.Get()), Pin(spi.Bus.PSEL.MISO.Get())
 }
 
-// Configure configures an ADC pin to be able to read analog data.
-func (a ADC) Configure() error {
-	return nil // no pin specific setup on nrf52840 machine.
+// disconnectPins disconnects the SPI peripheral from its pins.
+func (spi SPI) disconnectPins() {
+	spi.Bus.PSEL.SCK.Set(pselDisconnected)
+	spi.Bus.PSEL.MOSI.Set(pselDisconnected)
+	spi.Bus.PSEL.MISO.Set(pselDisconnected)
 }
 
-// Get returns the current value of a ADC pin in the range 0..0xffff.
-func (a ADC) Get() uint16 {
-	var pwmPin uint32
-	var value int16
-
-	switch a.Pin {
-	case 2:
-		pwmPin = nrf.SAADC_CH_PSELP_PSELP_AnalogInput0
-
-	case 3:
-		pwmPin = nrf.SAADC_CH_PSELP_PSELP_AnalogInput1
-
-	case 4:
-		pwmPin = nrf.SAADC_CH_PSELP_PSELP_AnalogInput2
-
-	case 5:
-		pwmPin = nrf.SAADC_CH_PSELP_PSELP_AnalogInput3
-
-	case 28:
-		pwmPin = nrf.SAADC_CH_PSELP_PSELP_AnalogInput4
-
-	case 29:
-		pwmPin = nrf.SAADC_CH_PSELP_PSELP_AnalogInput5
-
-	case 30:
-		pwmPin = nrf.SAADC_CH_PSELP_PSELP_AnalogInput6
-
-	case 31:
-		pwmPin = nrf.SAADC_CH_PSELP_PSELP_AnalogInput7
-
-	default:
-		return 0
-	}
-
-	nrf.SAADC.RESOLUTION.Set(nrf.SAADC_RESOLUTION_VAL_12bit)
-
-	// Enable ADC.
-	nrf.SAADC.ENABLE.Set(nrf.SAADC_ENABLE_ENABLE_Enabled << nrf.SAADC_ENABLE_ENABLE_Pos)
-	for i := 0; i < 8; i++ {
-		nrf.SAADC.CH[i].PSELN.Set(nrf.SAADC_CH_PSELP_PSELP_NC)
-		nrf.SAADC.CH[i].PSELP.Set(nrf.SAADC_CH_PSELP_PSELP_NC)
-	}
-
-	// Configure ADC.
-	nrf.SAADC.CH[0].CONFIG.Set(((nrf.SAADC_CH_CONFIG_RESP_Bypass << nrf.SAADC_CH_CONFIG_RESP_Pos) & nrf.SAADC_CH_CONFIG_RESP_Msk) |
-		((nrf.SAADC_CH_CONFIG_RESP_Bypass << nrf.SAADC_CH_CONFIG_RESN_Pos) & nrf.SAADC_CH_CONFIG_RESN_Msk) |
-		((nrf.SAADC_CH_CONFIG_GAIN_Gain1_5 << nrf.SAADC_CH_CONFIG_GAIN_Pos) & nrf.SAADC_CH_CONFIG_GAIN_Msk) |
-		((nrf.SAADC_CH_CONFIG_REFSEL_Internal << nrf.SAADC_CH_CONFIG_REFSEL_Pos) & nrf.SAADC_CH_CONFIG_REFSEL_Msk) |
-		((nrf.SAADC_CH_CONFIG_TACQ_3us << nrf.SAADC_CH_CONFIG_TACQ_Pos) & nrf.SAADC_CH_CONFIG_TACQ_Msk) |
-		((nrf.SAADC_CH_CONFIG_MODE_SE << nrf.SAADC_CH_CONFIG_MODE_Pos) & nrf.SAADC_CH_CONFIG_MODE_Msk))
-
-	// Set pin to read.
-	nrf.SAADC.CH[0].PSELN.Set(pwmPin)
-	nrf.SAADC.CH[0].PSELP.Set(pwmPin)
-
-	// Destination for sample result.
-	nrf.SAADC.RESULT.PTR.Set(uint32(uintptr(unsafe.Pointer(&value))))
-	nrf.SAADC.RESULT.MAXCNT.Set(1) // One sample
-
-	// Start tasks.
-	nrf.SAADC.TASKS_START.Set(1)
-	for nrf.SAADC.EVENTS_STARTED.Get() == 0 {
-	}
-	nrf.SAADC.EVENTS_STARTED.Set(0x00)
-
-	// Start the sample task.
-	nrf.SAADC.TASKS_SAMPLE.Set(1)
-
-	// Wait until the sample task is done.
-	for nrf.SAADC.EVENTS_END.Get() == 0 {
-	}
-	nrf.SAADC.EVENTS_END.Set(0x00)
-
-	// Stop the ADC
-	nrf.SAADC.TASKS_STOP.Set(1)
-	for nrf.SAADC.EVENTS_STOPPED.Get() == 0 {
+// enableInterrupt enables the interrupt of the peripheral slot of this SPI
+// instance, which calls the handler set with setInterruptHandler.
+func (spi SPI) enableInterrupt() {
+	var intr interrupt.Interrupt
+	if spi.Bus == nrf.SPI0 {
+		intr = interrupt.New(nrf.IRQ_SPIM0_SPIS0_TWIM0_TWIS0_SPI0_TWI0, func(interrupt.Interrupt) {
+			handleSPIInterrupt(0)
+		})
+	} else {
+		intr = interrupt.New(nrf.IRQ_SPIM1_SPIS1_TWIM1_TWIS1_SPI1_TWI1, func(interrupt.Interrupt) {
+			handleSPIInterrupt(1)
+		})
 	}
-	nrf.SAADC.EVENTS_STOPPED.Set(0)
-
-	// Disable the ADC.
-	nrf.SAADC.ENABLE.Set(nrf.SAADC_ENABLE_ENABLE_Disabled << nrf.SAADC_ENABLE_ENABLE_Pos)
+	intr.SetPriority(interruptPriorityLow)
+	intr.Enable()
+}
 
-	if value < 0 {
-		value = 0
-	}
+// InitADC initializes the registers needed for ADC.
+func InitADC() {
+	return // no specific setup on nrf52840 machine.
+}
 
-	// Return 16-bit result from 12-bit value.
-	return uint16(value << 4)
+// Configure configures an ADC pin to be able to read analog data.
+func (a ADC) Configure() error {
+	a.Pin.Configure(PinConfig{Mode: PinAnalog})
+	return nil
 }
 
 // PWM
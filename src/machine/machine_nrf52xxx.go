@@ -0,0 +1,1544 @@
+// +build nrf52 nrf52833 nrf52840
+
+package machine
+
+import (
+	"device/nrf"
+	"errors"
+	"runtime/interrupt"
+	"runtime/volatile"
+	"unsafe"
+)
+
+var (
+	ErrInvalidCaptureSize = errors.New("machine: capture buffer is smaller than the number of edges")
+	ErrNFCPin             = errors.New("machine: pin is used for NFC, set UICR.NFCPINS to disabled to use it as GPIO")
+	ErrResetPin           = errors.New("machine: pin is used as reset pin, call DisableResetPin to use it as GPIO")
+	ErrNoFreePWM          = errors.New("machine: all PWM peripherals are in use")
+)
+
+// checkReserved returns an error if this pin can't be used as GPIO (or by a
+// peripheral) because the UICR assigns it to another function, so that a
+// misconfiguration doesn't silently fail.
+func (p Pin) checkReserved() error {
+	if p == 9 || p == 10 {
+		// P0.09 and P0.10 are the NFC antenna pins unless disabled in UICR.
+		if nrf.UICR.NFCPINS.Get()&nrf.UICR_NFCPINS_PROTECT_Msk == nrf.UICR_NFCPINS_PROTECT_NFC<<nrf.UICR_NFCPINS_PROTECT_Pos {
+			return ErrNFCPin
+		}
+	}
+	if p == ResetPin() {
+		return ErrResetPin
+	}
+	return nil
+}
+
+// ResetPin returns the pin that the UICR configures as reset pin, or NoPin if
+// the reset function is disabled. This is P0.21 on the nrf52832 and P0.18 on
+// the nrf52833 and nrf52840, when enabled. The reset pin can't be used as GPIO:
+// configuring it does nothing, as the reset function takes precedence.
+func ResetPin() Pin {
+	reset := nrf.UICR.PSELRESET[0].Get()
+	if reset&nrf.UICR_PSELRESET_CONNECT_Msk != nrf.UICR_PSELRESET_CONNECT_Connected<<nrf.UICR_PSELRESET_CONNECT_Pos {
+		return NoPin
+	}
+	// The lower 6 bits are the pin number, including the port on the nrf52833
+	// and nrf52840.
+	return Pin(reset & 0x3f)
+}
+
+// DisableResetPin disables the reset function of the reset pin in the UICR, so
+// that it can be used as a normal GPIO pin. The change only takes effect after
+// the next reset, as the UICR is only read at startup: call it once, then reset
+// the chip. It does nothing if the reset pin is already disabled. The chip can
+// still be reset through the debug interface or in software.
+//
+// The disconnect bit of PSELRESET can only be set by erasing the entire UICR,
+// so the other UICR registers (including the bootloader address, NFCPINS and
+// APPROTECT) are copied to the stack first and written back afterwards. Don't
+// remove power while this runs: the UICR would be left (partially) erased. The
+// CPU stalls while the UICR is erased and written, for around 10ms. The NVMC
+// belongs to the SoftDevice while it is enabled, so this can't be used then.
+func DisableResetPin() {
+	if ResetPin() == NoPin {
+		return
+	}
+	const words = unsafe.Sizeof(nrf.UICR_Type{}) / 4
+	const pselreset = unsafe.Offsetof(nrf.UICR_Type{}.PSELRESET) / 4
+	base := uintptr(unsafe.Pointer(nrf.UICR))
+	var saved [words]uint32
+	for i := range saved {
+		saved[i] = volatile.LoadUint32((*uint32)(unsafe.Pointer(base + uintptr(i)*4)))
+	}
+	// Both PSELRESET registers must hold the same value.
+	saved[pselreset] = 0xffffffff
+	saved[pselreset+1] = 0xffffffff
+
+	mask := interrupt.Disable()
+	nrf.NVMC.CONFIG.Set(nrf.NVMC_CONFIG_WEN_Een)
+	waitForFlash()
+	nrf.NVMC.ERASEUICR.Set(nrf.NVMC_ERASEUICR_ERASEUICR_Erase)
+	waitForFlash()
+	nrf.NVMC.CONFIG.Set(nrf.NVMC_CONFIG_WEN_Wen)
+	waitForFlash()
+	for i, word := range saved {
+		// Erased words are already 0xffffffff.
+		if word != 0xffffffff {
+			volatile.StoreUint32((*uint32)(unsafe.Pointer(base+uintptr(i)*4)), word)
+			waitForFlash()
+		}
+	}
+	nrf.NVMC.CONFIG.Set(nrf.NVMC_CONFIG_WEN_Ren)
+	interrupt.Restore(mask)
+}
+
+// The timer used by CaptureEdges and CountPulses. TIMER0 is reserved by the
+// SoftDevice, so TIMER1 is used instead.
+var captureTimer = nrf.TIMER1
+
+// CaptureEdgesTickDuration is the duration (in nanoseconds) of a single tick
+// in the timestamps returned by CaptureEdges.
+const CaptureEdgesTickDuration = 1000
+
+// CaptureEdges waits for the given number of edges (both rising and falling) on
+// this pin and stores the time of each edge in buf. Timestamps are in ticks of
+// 1µs (see CaptureEdgesTickDuration), counted from the moment CaptureEdges was
+// called. The pin must already be configured as an input.
+//
+// The timestamp of each edge is captured in hardware using GPIOTE, PPI and
+// TIMER1, so it is not affected by interrupt latency. However, the CPU still
+// needs to copy each timestamp before the next edge arrives: edges that are
+// less than a few microseconds apart may be missed.
+//
+// This call blocks until all edges have been captured. It returns ErrBusInUse
+// while a pulse counter is running, as that uses the same timer.
+func (p Pin) CaptureEdges(buf []uint32, edges int) error {
+	if edges > len(buf) {
+		return ErrInvalidCaptureSize
+	}
+	if pulseCounter.running {
+		return ErrBusInUse
+	}
+
+	ppi, err := AllocatePPIChannel()
+	if err != nil {
+		return err
+	}
+	defer ppi.Release()
+
+	// Use a GPIOTE channel to generate an event on each edge.
+	channel, err := AllocateGPIOTEChannel()
+	if err != nil {
+		return err
+	}
+	defer channel.Release()
+
+	// Configure the timer to run at 1MHz (16MHz / 2^4).
+	captureTimer.TASKS_STOP.Set(1)
+	captureTimer.MODE.Set(nrf.TIMER_MODE_MODE_Timer)
+	captureTimer.BITMODE.Set(nrf.TIMER_BITMODE_BITMODE_32Bit)
+	captureTimer.PRESCALER.Set(4)
+	captureTimer.TASKS_CLEAR.Set(1)
+
+	// Capture the timer value on each GPIOTE event.
+	ppi.Connect(&nrf.GPIOTE.EVENTS_IN[channel], &captureTimer.TASKS_CAPTURE[0])
+	ppi.Enable()
+
+	nrf.GPIOTE.EVENTS_IN[channel].Set(0)
+	channel.ConfigureEvent(p, PinToggle)
+	captureTimer.TASKS_START.Set(1)
+
+	for i := 0; i < edges; i++ {
+		for nrf.GPIOTE.EVENTS_IN[channel].Get() == 0 {
+		}
+		nrf.GPIOTE.EVENTS_IN[channel].Set(0)
+		buf[i] = captureTimer.CC[0].Get()
+	}
+
+	captureTimer.TASKS_STOP.Set(1)
+
+	return nil
+}
+
+// State of the pulse counter started with CountPulses.
+var pulseCounter struct {
+	running bool
+	channel GPIOTEChannel
+	ppi     PPIChannel
+}
+
+// PulseCounter is a hardware counter of the pulses on a pin, started with
+// Pin.CountPulses.
+type PulseCounter struct{}
+
+// CountPulses starts counting the edges of the given kind (PinRising,
+// PinFalling or PinToggle for both) on this pin in hardware, for example the
+// pulses of a flow meter or an anemometer. Every edge generates a GPIOTE event
+// that increments TIMER1 in counter mode through PPI, so the CPU is not
+// involved at all: no pulse is missed, even at rates of several MHz or when
+// interrupts are disabled, and the CPU can sleep. Read the count with Count.
+// The pin must already be configured as an input.
+//
+// Only one pulse counter can run at a time, and CaptureEdges can't be used
+// while it runs, as they share TIMER1: ErrBusInUse is returned in both cases.
+// It needs a free GPIOTE channel and a free PPI channel until Stop is called.
+// Like the GPIOTE events of SetInterrupt, it keeps the high frequency clock
+// running while the CPU sleeps.
+func (p Pin) CountPulses(change PinChange) (PulseCounter, error) {
+	if pulseCounter.running {
+		return PulseCounter{}, ErrBusInUse
+	}
+	channel, err := AllocateGPIOTEChannel()
+	if err != nil {
+		return PulseCounter{}, err
+	}
+	ppi, err := AllocatePPIChannel()
+	if err != nil {
+		channel.Release()
+		return PulseCounter{}, err
+	}
+	pulseCounter.running = true
+	pulseCounter.channel = channel
+	pulseCounter.ppi = ppi
+
+	captureTimer.TASKS_STOP.Set(1)
+	captureTimer.MODE.Set(nrf.TIMER_MODE_MODE_Counter)
+	captureTimer.BITMODE.Set(nrf.TIMER_BITMODE_BITMODE_32Bit)
+	captureTimer.SHORTS.Set(0)
+	captureTimer.TASKS_CLEAR.Set(1)
+	captureTimer.TASKS_START.Set(1)
+
+	ppi.Connect(&nrf.GPIOTE.EVENTS_IN[channel], &captureTimer.TASKS_COUNT)
+	ppi.Enable()
+	channel.ConfigureEvent(p, change)
+	return PulseCounter{}, nil
+}
+
+// Count returns the number of pulses since CountPulses or the last Reset. The
+// count wraps around after 2^32 pulses.
+func (c PulseCounter) Count() uint32 {
+	if !pulseCounter.running {
+		return 0
+	}
+	captureTimer.TASKS_CAPTURE[0].Set(1)
+	return captureTimer.CC[0].Get()
+}
+
+// Reset sets the count back to zero.
+func (c PulseCounter) Reset() {
+	if pulseCounter.running {
+		captureTimer.TASKS_CLEAR.Set(1)
+	}
+}
+
+// Stop stops counting and frees the timer and the GPIOTE and PPI channels.
+func (c PulseCounter) Stop() {
+	if !pulseCounter.running {
+		return
+	}
+	pulseCounter.ppi.Release()
+	pulseCounter.channel.Release()
+	captureTimer.TASKS_STOP.Set(1)
+	captureTimer.MODE.Set(nrf.TIMER_MODE_MODE_Timer)
+	pulseCounter.running = false
+}
+
+// pulseTimer is the timer used to time HardwarePulse and SquareWave.
+var pulseTimer = nrf.TIMER3
+
+// HardwarePulse drives the pin to the given level for ns nanoseconds and then
+// back to the opposite level, like Pulse, but with the pulse generated in
+// hardware by a timer that toggles the pin through PPI and GPIOTE. Its width is
+// accurate to 62.5ns (the timer runs at 16MHz) and is not affected by
+// interrupts or the scheduler, which makes it suitable for short trigger pulses
+// such as the 10µs trigger of an HC-SR04 ultrasonic sensor. The pulse must be
+// at least 62.5ns long, and at most about 4.29s, the largest ns that fits in a
+// uint32.
+//
+// The pin must be configured as an output; it is at the opposite level when
+// HardwarePulse returns. This call blocks until the pulse is complete. It needs
+// a free GPIOTE channel and two free PPI channels while it runs.
+func (p Pin) HardwarePulse(level bool, ns uint32) error {
+	ticks := uint32(uint64(ns) * 16 / 1000)
+	if ticks == 0 {
+		return ErrInvalidConfig
+	}
+	if squareWave.running {
+		return ErrBusInUse // the timer is in use
+	}
+
+	channel, err := AllocateGPIOTEChannel()
+	if err != nil {
+		return err
+	}
+	defer channel.Release()
+	start, err := AllocatePPIChannel()
+	if err != nil {
+		return err
+	}
+	defer start.Release()
+	end, err := AllocatePPIChannel()
+	if err != nil {
+		return err
+	}
+	defer end.Release()
+
+	// Keep the pin at the idle level after the GPIOTE channel is released.
+	p.Set(!level)
+	channel.ConfigureTask(p, !level)
+
+	// Toggle the pin at the first compare event and again at the second one,
+	// after which the timer stops.
+	pulseTimer.TASKS_STOP.Set(1)
+	pulseTimer.MODE.Set(nrf.TIMER_MODE_MODE_Timer)
+	pulseTimer.BITMODE.Set(nrf.TIMER_BITMODE_BITMODE_32Bit)
+	pulseTimer.PRESCALER.Set(0)
+	pulseTimer.CC[0].Set(1)
+	pulseTimer.CC[1].Set(1 + ticks)
+	pulseTimer.SHORTS.Set(nrf.TIMER_SHORTS_COMPARE1_STOP_Msk)
+	pulseTimer.EVENTS_COMPARE[1].Set(0)
+	start.Connect(&pulseTimer.EVENTS_COMPARE[0], &nrf.GPIOTE.TASKS_OUT[channel])
+	start.Enable()
+	end.Connect(&pulseTimer.EVENTS_COMPARE[1], &nrf.GPIOTE.TASKS_OUT[channel])
+	end.Enable()
+
+	pulseTimer.TASKS_CLEAR.Set(1)
+	pulseTimer.TASKS_START.Set(1)
+	for pulseTimer.EVENTS_COMPARE[1].Get() == 0 {
+	}
+	pulseTimer.EVENTS_COMPARE[1].Set(0)
+	pulseTimer.SHORTS.Set(0)
+	return nil
+}
+
+// State of the square wave started with SquareWave.
+var squareWave struct {
+	running bool
+	pin     Pin
+	channel GPIOTEChannel
+	ppi     PPIChannel
+}
+
+// SquareWave starts toggling the pin at the given frequency in Hz, with a 50%
+// duty cycle, until StopSquareWave is called. The wave is generated in
+// hardware by a timer that toggles the pin through PPI and GPIOTE, so it runs
+// without any CPU involvement, for example to clock an external ADC. This is
+// lighter than PWM when a plain clock is all that is needed.
+//
+// The timer runs at 16MHz and toggles the pin every half period, so the
+// frequency must be between 1Hz and 8MHz and is rounded to the nearest
+// frequency of 8MHz/n. Its accuracy is that of the HFCLK: call RequestHFXO
+// first for a crystal accurate clock. Only one square wave can run at a time,
+// and it shares its timer with HardwarePulse, which returns ErrBusInUse while
+// the wave runs. It needs a free GPIOTE channel and a free PPI channel.
+func (p Pin) SquareWave(freq uint32) error {
+	if freq == 0 || freq > 8000000 {
+		return ErrInvalidConfig
+	}
+	if squareWave.running {
+		return ErrBusInUse
+	}
+	channel, err := AllocateGPIOTEChannel()
+	if err != nil {
+		return err
+	}
+	ppi, err := AllocatePPIChannel()
+	if err != nil {
+		channel.Release()
+		return err
+	}
+	squareWave.running = true
+	squareWave.pin = p
+	squareWave.channel = channel
+	squareWave.ppi = ppi
+
+	// Keep the pin low after the GPIOTE channel is released.
+	p.Configure(PinConfig{Mode: PinOutput})
+	p.Low()
+	channel.ConfigureTask(p, false)
+
+	// Toggle the pin at every compare event, which also restarts the timer.
+	halfPeriod := (8000000 + freq/2) / freq
+	pulseTimer.TASKS_STOP.Set(1)
+	pulseTimer.MODE.Set(nrf.TIMER_MODE_MODE_Timer)
+	pulseTimer.BITMODE.Set(nrf.TIMER_BITMODE_BITMODE_32Bit)
+	pulseTimer.PRESCALER.Set(0)
+	pulseTimer.CC[0].Set(halfPeriod)
+	pulseTimer.SHORTS.Set(nrf.TIMER_SHORTS_COMPARE0_CLEAR_Msk)
+	ppi.Connect(&pulseTimer.EVENTS_COMPARE[0], &nrf.GPIOTE.TASKS_OUT[channel])
+	ppi.Enable()
+	pulseTimer.TASKS_CLEAR.Set(1)
+	pulseTimer.TASKS_START.Set(1)
+	return nil
+}
+
+// StopSquareWave stops the square wave started with SquareWave and leaves the
+// pin low. It does nothing if no square wave is running on this pin.
+func (p Pin) StopSquareWave() {
+	if !squareWave.running || squareWave.pin != p {
+		return
+	}
+	pulseTimer.TASKS_STOP.Set(1)
+	pulseTimer.SHORTS.Set(0)
+	pulseTimer.EVENTS_COMPARE[0].Set(0)
+	squareWave.ppi.Release()
+	squareWave.channel.Release()
+	squareWave.running = false
+}
+
+// Registers of the DWT cycle counter in the Cortex-M4 core.
+var (
+	demCR     = (*volatile.Register32)(unsafe.Pointer(uintptr(0xe000edfc))) // debug exception and monitor control
+	dwtCR     = (*volatile.Register32)(unsafe.Pointer(uintptr(0xe0001000)))
+	dwtCYCCNT = (*volatile.Register32)(unsafe.Pointer(uintptr(0xe0001004)))
+)
+
+const (
+	demCRTraceEnable      = 0x01000000 // enable debugging & monitoring blocks
+	dwtCRCycleCountEnable = 0x00000001 // cycle count register
+)
+
+// enableCycleCounter starts the DWT cycle counter if it isn't running yet.
+func enableCycleCounter() {
+	if !dwtCR.HasBits(dwtCRCycleCountEnable) {
+		demCR.SetBits(demCRTraceEnable)
+		dwtCR.SetBits(dwtCRCycleCountEnable)
+	}
+}
+
+// DelayMicroseconds busy-waits for the given number of microseconds.
+//
+// The delay is measured with the DWT cycle counter of the CPU, so it does not
+// depend on compiler optimizations or flash wait states. The counter runs at
+// CPUFrequency, so the delay is accurate to within about a microsecond, but it
+// will be longer if an interrupt happens during the delay. Unlike time.Sleep, it does
+// not yield to other goroutines, so it should only be used for short delays.
+func DelayMicroseconds(us uint32) {
+	enableCycleCounter()
+	cyclesPerMicrosecond := CPUFrequency() / 1000000
+	for us != 0 {
+		// Limit a single wait to one second to avoid overflowing the cycle
+		// counter.
+		n := us
+		if n > 1000000 {
+			n = 1000000
+		}
+		us -= n
+		cycles := n * cyclesPerMicrosecond
+		start := dwtCYCCNT.Get()
+		for dwtCYCCNT.Get()-start < cycles {
+		}
+	}
+}
+
+// delayNanoseconds waits at least the given number of nanoseconds, rounded up
+// to whole microseconds.
+func delayNanoseconds(ns uint32) {
+	DelayMicroseconds((ns + 999) / 1000)
+}
+
+// Pulse drives the pin to the given level for the given number of
+// microseconds and then drives it to the opposite level, for example to
+// generate a reset or strobe pulse. The pin must be configured as an output.
+//
+// The duration is not a time.Duration because the runtime imports this
+// package, so it cannot import the time package.
+func (p Pin) Pulse(level bool, us uint32) {
+	p.Set(level)
+	DelayMicroseconds(us)
+	p.Set(!level)
+}
+
+// TxTimed works like Tx, but also returns the duration of the transfer in CPU
+// cycles (see CPUFrequency), measured with the DWT cycle counter from just
+// before the first byte is written until the last byte has been received. This
+// gives a resolution of about 16ns, which is enough to measure the jitter of
+// transfers in a control loop: call it repeatedly and compare the durations.
+//
+// The legacy SPI peripheral has no END event that a TIMER could capture through
+// PPI, so the end of the transfer is detected by the polling loop in Tx. This
+// adds a constant offset of a few cycles, but doesn't add jitter. Interrupts
+// during the transfer do, and will show up in the measurement: that is usually
+// what needs to be found out.
+func (spi SPI) TxTimed(w, r []byte) (cycles uint32, err error) {
+	enableCycleCounter()
+	start := dwtCYCCNT.Get()
+	err = spi.Tx(w, r)
+	return dwtCYCCNT.Get() - start, err
+}
+
+// MeasureFrequency measures the real SCK frequency of the bus in Hz, as a
+// check of Frequency during board bring-up: it transfers 8 and then 72 bytes
+// of zeros, times both transfers with the DWT cycle counter and computes the
+// bit rate from the difference, which cancels out the fixed overhead of a
+// transfer. This works because Tx keeps the clock running without gaps between
+// bytes. The result is accurate to within one CPU cycle per 512 clock periods,
+// except with the spi_log or spi_capture build tags, which add time that
+// depends on the length of the transfer.
+//
+// Interrupts are disabled during the measurement, for up to 5ms at the lowest
+// frequency. The bytes are really sent, so make sure that no device is
+// selected, or that the selected device ignores them.
+func (spi SPI) MeasureFrequency() (uint32, error) {
+	var buf [72]byte
+	mask := interrupt.Disable()
+	short, err := spi.TxTimed(nil, buf[:8])
+	var long uint32
+	if err == nil {
+		long, err = spi.TxTimed(nil, buf[:])
+	}
+	interrupt.Restore(mask)
+	if err != nil {
+		return 0, err
+	}
+	const bits = (72 - 8) * 8
+	return uint32(uint64(bits) * uint64(CPUFrequency()) / uint64(long-short)), nil
+}
+
+// spiTriggerTimer is the timer that starts the transfers of TriggerOnTimer.
+var spiTriggerTimer = nrf.TIMER4
+
+// State of the periodic transfer started with TriggerOnTimer.
+var spiTrigger struct {
+	running bool
+	spi     SPI
+	cs      Pin
+	w, r    []byte
+	done    func(err error)
+}
+
+// TriggerOnTimer starts a transfer of w and r like TxWithCallback every period
+// microseconds, until StopTrigger is called. The transfers are timed by a
+// hardware timer instead of the scheduler, for example to read a sensor at an
+// exact sample rate. If cs is not NoPin, it is configured as an output and
+// driven low for the duration of every transfer. After every transfer done is
+// called from the SPI interrupt, and r holds the received data until the next
+// transfer starts.
+//
+// The legacy SPI peripheral has no START task that a TIMER could trigger
+// through PPI. Instead, the timer interrupt starts the transfer at high
+// priority, so the start of every transfer is only delayed by the interrupt
+// latency (well below 1µs) and doesn't drift. Every transfer must be complete
+// before the next one starts: if the bus is still busy (or in use by another
+// driver), that transfer is skipped and done is called with ErrBusInUse. Only
+// one periodic transfer can run at a time.
+//
+// The buffers are used until StopTrigger returns, so the rules of
+// TxWithCallback apply: w must not change while a transfer may be running,
+// which is best done by only changing it from done.
+func (spi SPI) TriggerOnTimer(period uint32, cs Pin, w, r []byte, done func(err error)) error {
+	if period == 0 {
+		return ErrInvalidConfig
+	}
+	if len(w) != 0 && len(r) != 0 && len(r) != len(w) {
+		return ErrTxInvalidSliceSize
+	}
+	if spiTrigger.running {
+		return ErrBusInUse
+	}
+	if cs != NoPin {
+		cs.Configure(PinConfig{Mode: PinOutput})
+		cs.High()
+	}
+	spiTrigger.spi = spi
+	spiTrigger.cs = cs
+	spiTrigger.w = w
+	spiTrigger.r = r
+	spiTrigger.done = done
+	spiTrigger.running = true
+
+	// Run the timer at 1MHz and restart it on every compare event.
+	spiTriggerTimer.TASKS_STOP.Set(1)
+	spiTriggerTimer.MODE.Set(nrf.TIMER_MODE_MODE_Timer)
+	spiTriggerTimer.BITMODE.Set(nrf.TIMER_BITMODE_BITMODE_32Bit)
+	spiTriggerTimer.PRESCALER.Set(4)
+	spiTriggerTimer.CC[0].Set(period)
+	spiTriggerTimer.SHORTS.Set(nrf.TIMER_SHORTS_COMPARE0_CLEAR_Msk)
+	spiTriggerTimer.EVENTS_COMPARE[0].Set(0)
+	spiTriggerTimer.INTENSET.Set(nrf.TIMER_INTENSET_COMPARE0_Msk)
+	intr := interrupt.New(nrf.IRQ_TIMER4, handleSPITrigger)
+	intr.SetPriority(interruptPriorityHigh)
+	intr.Enable()
+	spiTriggerTimer.TASKS_CLEAR.Set(1)
+	spiTriggerTimer.TASKS_START.Set(1)
+	return nil
+}
+
+// StopTrigger stops the periodic transfer started with TriggerOnTimer. If a
+// transfer is in progress, it waits until it is complete, so the chip select
+// is high and no callback is pending when it returns. It does nothing if no
+// periodic transfer is running on this bus.
+func (spi SPI) StopTrigger() {
+	if !spiTrigger.running || spiTrigger.spi != spi {
+		return
+	}
+	spiTriggerTimer.TASKS_STOP.Set(1)
+	spiTriggerTimer.INTENCLR.Set(nrf.TIMER_INTENCLR_COMPARE0_Msk)
+	spiTriggerTimer.SHORTS.Set(0)
+	spiTriggerTimer.EVENTS_COMPARE[0].Set(0)
+	for spiAsync[spi.index()].n != 0 {
+	}
+	spiTrigger.running = false
+	spiTrigger.w = nil
+	spiTrigger.r = nil
+	spiTrigger.done = nil
+}
+
+// handleSPITrigger is the timer interrupt handler that starts a transfer of
+// TriggerOnTimer.
+func handleSPITrigger(interrupt.Interrupt) {
+	spiTriggerTimer.EVENTS_COMPARE[0].Set(0)
+	t := &spiTrigger
+	if !t.running {
+		return
+	}
+	if t.cs != NoPin {
+		t.cs.Low()
+	}
+	if err := t.spi.TxWithCallback(t.w, t.r, spiTriggerDone); err != nil {
+		if t.cs != NoPin {
+			t.cs.High()
+		}
+		if t.done != nil {
+			t.done(err)
+		}
+	}
+}
+
+// spiTriggerDone is called when a transfer of TriggerOnTimer is complete.
+func spiTriggerDone(err error) {
+	t := &spiTrigger
+	if t.cs != NoPin {
+		t.cs.High()
+	}
+	if t.done != nil {
+		t.done(err)
+	}
+}
+
+// ADCConfig holds the SAADC settings used by Get for a given ADC pin. The zero
+// value is the default configuration.
+type ADCConfig struct {
+	// Samples is the number of samples that are averaged in hardware for a
+	// single Get call using the SAADC oversampling feature. It must be a power
+	// of two up to 256. The values 0 and 1 disable oversampling.
+	//
+	// Every sample takes the acquisition time (3µs by default, see
+	// AcquisitionTime) plus the conversion time (about 2µs), so with
+	// oversampling a Get call takes roughly Samples * 5µs. For example, 256
+	// samples limit the sample rate to about 780Hz.
+	Samples uint32
+
+	// Burst makes the SAADC take all oversampling samples of a Get call in a
+	// single burst, triggered once, instead of one sample per trigger. The
+	// CPU only waits for the end of the burst, without any work per sample,
+	// and the samples are taken back to back. It has no effect without
+	// oversampling.
+	Burst bool
+
+	// AcquisitionTime is the time in microseconds the SAADC samples the input
+	// before every conversion. It must be 3, 5, 10, 15, 20 or 40; the zero
+	// value means 3µs. Sources with a high output impedance, such as a voltage
+	// divider with large resistors, need a longer acquisition time or they will
+	// read low. The datasheet lists the maximum source resistance for every
+	// acquisition time, from 10kΩ at 3µs to 800kΩ at 40µs; a 1MΩ divider has a
+	// source resistance of 500kΩ when both resistors are equal.
+	AcquisitionTime uint32
+
+	// Reference is the reference voltage of the conversion and Gain the gain
+	// applied to the input. Together they set the full-scale input range,
+	// which is the reference voltage divided by the gain. The zero values are
+	// the internal reference with a gain of 1/5, for a range of 0-3.0V.
+	//
+	//	Gain   Internal (0.6V)   VDD/4
+	//	1/6    0-3.6V            0-VDD*1.5
+	//	1/5    0-3.0V            0-VDD*1.25
+	//	1/4    0-2.4V            0-VDD
+	//	1/3    0-1.8V            0-VDD*0.75
+	//	1/2    0-1.2V            0-VDD*0.5
+	//	1      0-0.6V            0-VDD*0.25
+	//	2      0-0.3V            0-VDD*0.125
+	//	4      0-0.15V           0-VDD*0.0625
+	//
+	// The input voltage must never exceed VDD, whatever the range. For a 0-3.3V
+	// sensor powered from VDD, use ADCReferenceVDD4 with ADCGain1_4.
+	Reference ADCReference
+	Gain      ADCGain
+
+	// SampleRate is the sample rate in Hz used by StartContinuous. It must be
+	// between 7813Hz and 200kHz; the zero value means 10kHz. It is not used by
+	// Get. The sample period must be longer than the acquisition time plus
+	// the conversion time, so long acquisition times lower the maximum rate.
+	SampleRate uint32
+}
+
+// ADCReference is the reference voltage of the SAADC.
+type ADCReference uint8
+
+const (
+	ADCReferenceInternal ADCReference = iota // internal 0.6V reference
+	ADCReferenceVDD4                         // VDD/4
+)
+
+// ADCGain is the gain the SAADC applies to the input voltage.
+type ADCGain uint8
+
+const (
+	ADCGain1_5 ADCGain = iota // default
+	ADCGain1_6
+	ADCGain1_4
+	ADCGain1_3
+	ADCGain1_2
+	ADCGain1
+	ADCGain2
+	ADCGain4
+)
+
+// Configuration of every analog input, as set with ADC.SetConfig.
+var adcConfigs [8]ADCConfig
+
+// SetConfig changes the SAADC settings that are used when reading this ADC pin.
+func (a ADC) SetConfig(config ADCConfig) error {
+	ch := a.channel()
+	if ch < 0 {
+		return ErrInvalidInputPin
+	}
+	if config.Samples > 256 || config.Samples&(config.Samples-1) != 0 {
+		return ErrInvalidConfig
+	}
+	if config.Reference > ADCReferenceVDD4 || config.Gain > ADCGain4 {
+		return ErrInvalidConfig
+	}
+	switch config.AcquisitionTime {
+	case 0, 3, 5, 10, 15, 20, 40:
+	default:
+		return ErrInvalidConfig
+	}
+	adcConfigs[ch] = config
+	return nil
+}
+
+// configValue returns the GAIN, REFSEL, TACQ and BURST bits of the SAADC
+// CH[n].CONFIG register for this configuration.
+func (config ADCConfig) configValue() uint32 {
+	var gain uint32
+	switch config.Gain {
+	case ADCGain1_6:
+		gain = nrf.SAADC_CH_CONFIG_GAIN_Gain1_6
+	case ADCGain1_4:
+		gain = nrf.SAADC_CH_CONFIG_GAIN_Gain1_4
+	case ADCGain1_3:
+		gain = nrf.SAADC_CH_CONFIG_GAIN_Gain1_3
+	case ADCGain1_2:
+		gain = nrf.SAADC_CH_CONFIG_GAIN_Gain1_2
+	case ADCGain1:
+		gain = nrf.SAADC_CH_CONFIG_GAIN_Gain1
+	case ADCGain2:
+		gain = nrf.SAADC_CH_CONFIG_GAIN_Gain2
+	case ADCGain4:
+		gain = nrf.SAADC_CH_CONFIG_GAIN_Gain4
+	default:
+		gain = nrf.SAADC_CH_CONFIG_GAIN_Gain1_5
+	}
+	refsel := uint32(nrf.SAADC_CH_CONFIG_REFSEL_Internal)
+	if config.Reference == ADCReferenceVDD4 {
+		refsel = nrf.SAADC_CH_CONFIG_REFSEL_VDD1_4
+	}
+	var tacq uint32
+	switch config.AcquisitionTime {
+	case 5:
+		tacq = nrf.SAADC_CH_CONFIG_TACQ_5us
+	case 10:
+		tacq = nrf.SAADC_CH_CONFIG_TACQ_10us
+	case 15:
+		tacq = nrf.SAADC_CH_CONFIG_TACQ_15us
+	case 20:
+		tacq = nrf.SAADC_CH_CONFIG_TACQ_20us
+	case 40:
+		tacq = nrf.SAADC_CH_CONFIG_TACQ_40us
+	default:
+		tacq = nrf.SAADC_CH_CONFIG_TACQ_3us
+	}
+	burst := uint32(nrf.SAADC_CH_CONFIG_BURST_Disabled)
+	if config.Burst {
+		burst = nrf.SAADC_CH_CONFIG_BURST_Enabled
+	}
+	return ((gain << nrf.SAADC_CH_CONFIG_GAIN_Pos) & nrf.SAADC_CH_CONFIG_GAIN_Msk) |
+		((refsel << nrf.SAADC_CH_CONFIG_REFSEL_Pos) & nrf.SAADC_CH_CONFIG_REFSEL_Msk) |
+		((tacq << nrf.SAADC_CH_CONFIG_TACQ_Pos) & nrf.SAADC_CH_CONFIG_TACQ_Msk) |
+		((burst << nrf.SAADC_CH_CONFIG_BURST_Pos) & nrf.SAADC_CH_CONFIG_BURST_Msk)
+}
+
+// channel returns the SAADC analog input number (AIN0-AIN7) of this pin, or -1
+// if the pin cannot be used as an analog input.
+func (a ADC) channel() int {
+	switch a.Pin {
+	case 2:
+		return 0
+	case 3:
+		return 1
+	case 4:
+		return 2
+	case 5:
+		return 3
+	case 28:
+		return 4
+	case 29:
+		return 5
+	case 30:
+		return 6
+	case 31:
+		return 7
+	default:
+		return -1
+	}
+}
+
+// Get returns the current value of a ADC pin in the range 0..0xffff.
+func (a ADC) Get() uint16 {
+	var value int16
+
+	ch := a.channel()
+	if ch < 0 {
+		return 0
+	}
+	if adcScan.count != 0 {
+		// The SAADC is busy with a background scan.
+		return adcScan.latest[ch].Get()
+	}
+	config := adcConfigs[ch]
+
+	// Oversampling takes 2^OVERSAMPLE samples for every result.
+	oversample := uint32(0)
+	for config.Samples>>(oversample+1) != 0 {
+		oversample++
+	}
+
+	adcSetup(ch, config, oversample)
+
+	// Destination for sample result.
+	nrf.SAADC.RESULT.PTR.Set(uint32(uintptr(unsafe.Pointer(&value))))
+	nrf.SAADC.RESULT.MAXCNT.Set(1) // One sample
+
+	// Start tasks.
+	nrf.SAADC.TASKS_START.Set(1)
+	for nrf.SAADC.EVENTS_STARTED.Get() == 0 {
+	}
+	nrf.SAADC.EVENTS_STARTED.Set(0x00)
+
+	// Start the sample task, once for every sample when oversampling, unless
+	// the SAADC takes all samples in a burst.
+	triggers := 1 << oversample
+	if config.Burst {
+		triggers = 1
+	}
+	for i := 0; i < triggers; i++ {
+		nrf.SAADC.EVENTS_DONE.Set(0)
+		nrf.SAADC.TASKS_SAMPLE.Set(1)
+		for nrf.SAADC.EVENTS_DONE.Get() == 0 {
+		}
+	}
+
+	// Wait until the sample task is done.
+	for nrf.SAADC.EVENTS_END.Get() == 0 {
+	}
+	nrf.SAADC.EVENTS_END.Set(0x00)
+
+	// Stop the ADC
+	nrf.SAADC.TASKS_STOP.Set(1)
+	for nrf.SAADC.EVENTS_STOPPED.Get() == 0 {
+	}
+	nrf.SAADC.EVENTS_STOPPED.Set(0)
+
+	// Disable the ADC.
+	nrf.SAADC.ENABLE.Set(nrf.SAADC_ENABLE_ENABLE_Disabled << nrf.SAADC_ENABLE_ENABLE_Pos)
+
+	if value < 0 {
+		value = 0
+	}
+
+	// Return 16-bit result from 12-bit value.
+	return uint16(value << 4)
+}
+
+// adcSetup configures and enables the SAADC to convert analog input ch on its
+// channel 0 with the given configuration.
+func adcSetup(ch int, config ADCConfig, oversample uint32) {
+	pwmPin := nrf.SAADC_CH_PSELP_PSELP_AnalogInput0 + uint32(ch)
+
+	nrf.SAADC.RESOLUTION.Set(nrf.SAADC_RESOLUTION_VAL_12bit)
+	nrf.SAADC.OVERSAMPLE.Set(oversample)
+
+	// Enable ADC.
+	nrf.SAADC.ENABLE.Set(nrf.SAADC_ENABLE_ENABLE_Enabled << nrf.SAADC_ENABLE_ENABLE_Pos)
+	for i := 0; i < 8; i++ {
+		nrf.SAADC.CH[i].PSELN.Set(nrf.SAADC_CH_PSELP_PSELP_NC)
+		nrf.SAADC.CH[i].PSELP.Set(nrf.SAADC_CH_PSELP_PSELP_NC)
+	}
+
+	// Configure ADC.
+	nrf.SAADC.CH[0].CONFIG.Set(((nrf.SAADC_CH_CONFIG_RESP_Bypass << nrf.SAADC_CH_CONFIG_RESP_Pos) & nrf.SAADC_CH_CONFIG_RESP_Msk) |
+		((nrf.SAADC_CH_CONFIG_RESP_Bypass << nrf.SAADC_CH_CONFIG_RESN_Pos) & nrf.SAADC_CH_CONFIG_RESN_Msk) |
+		config.configValue() |
+		((nrf.SAADC_CH_CONFIG_MODE_SE << nrf.SAADC_CH_CONFIG_MODE_Pos) & nrf.SAADC_CH_CONFIG_MODE_Msk))
+
+	// Set pin to read.
+	nrf.SAADC.CH[0].PSELN.Set(pwmPin)
+	nrf.SAADC.CH[0].PSELP.Set(pwmPin)
+
+	adcSetLimits(ch)
+}
+
+// State of a continuous capture started with StartContinuous.
+var adcContinuous struct {
+	bufs    [2][]uint16
+	filling int // index in bufs of the buffer that is being filled
+	onFull  func(buf []uint16)
+	ppi     PPIChannel
+}
+
+// StartContinuous starts sampling this ADC pin continuously at the sample rate
+// set with SetConfig, alternating between the two buffers bufA and bufB, which
+// must have the same length. Every time a buffer is full, onFull is called
+// with it while the SAADC keeps filling the other buffer, so no samples are
+// lost. The values have the same range as returned by Get. Oversampling is not
+// supported in continuous mode.
+//
+// The buffer switch is done in hardware (the END event starts the next buffer
+// through a PPI channel), so the SAADC can run at its maximum rate of 200kHz.
+// However, onFull is called from the SAADC interrupt and must return before
+// the other buffer is full: at sample rate f and buffer length n, it has n/f
+// seconds, for example 5ms for 1000 samples at 200kHz. Get must not be used
+// while a continuous capture is running; stop it first with StopContinuous.
+func (a ADC) StartContinuous(bufA, bufB []uint16, onFull func(buf []uint16)) error {
+	ch := a.channel()
+	if ch < 0 {
+		return ErrInvalidInputPin
+	}
+	if adcContinuous.onFull != nil || adcScan.count != 0 || adcVDDSample.done != nil {
+		return ErrBusInUse
+	}
+	if len(bufA) == 0 || len(bufA) != len(bufB) || len(bufA) > 0x7fff || onFull == nil {
+		return ErrInvalidConfig
+	}
+	config := adcConfigs[ch]
+	if config.Samples > 1 {
+		return ErrInvalidConfig
+	}
+	rate := config.SampleRate
+	if rate == 0 {
+		rate = 10000
+	}
+	// The internal timer runs at 16MHz, with a CC value from 80 to 2047.
+	cc := 16000000 / rate
+	if cc < 80 || cc > 2047 {
+		return ErrInvalidConfig
+	}
+
+	ppi, err := AllocatePPIChannel()
+	if err != nil {
+		return err
+	}
+	adcContinuous.bufs = [2][]uint16{bufA, bufB}
+	adcContinuous.filling = 0
+	adcContinuous.onFull = onFull
+	adcContinuous.ppi = ppi
+
+	adcSetup(ch, config, 0)
+	nrf.SAADC.SAMPLERATE.Set((cc << nrf.SAADC_SAMPLERATE_CC_Pos) |
+		(nrf.SAADC_SAMPLERATE_MODE_Timers << nrf.SAADC_SAMPLERATE_MODE_Pos))
+	nrf.SAADC.RESULT.PTR.Set(uint32(uintptr(unsafe.Pointer(&bufA[0]))))
+	nrf.SAADC.RESULT.MAXCNT.Set(uint32(len(bufA)))
+
+	// Restart the conversion in the next buffer as soon as one is full.
+	ppi.Connect(&nrf.SAADC.EVENTS_END, &nrf.SAADC.TASKS_START)
+	ppi.Enable()
+
+	// Start the first buffer. The pointer is latched on STARTED, so the next
+	// buffer can be set right away.
+	nrf.SAADC.EVENTS_END.Set(0)
+	nrf.SAADC.EVENTS_STARTED.Set(0)
+	nrf.SAADC.TASKS_START.Set(1)
+	for nrf.SAADC.EVENTS_STARTED.Get() == 0 {
+	}
+	nrf.SAADC.EVENTS_STARTED.Set(0)
+	nrf.SAADC.RESULT.PTR.Set(uint32(uintptr(unsafe.Pointer(&bufB[0]))))
+
+	nrf.SAADC.INTENSET.Set(nrf.SAADC_INTENSET_STARTED_Msk | nrf.SAADC_INTENSET_END_Msk)
+	enableADCInterrupt()
+
+	// Start the internal sample timer.
+	nrf.SAADC.TASKS_SAMPLE.Set(1)
+	return nil
+}
+
+// StopContinuous stops a continuous capture started with StartContinuous. The
+// buffer that was being filled is discarded.
+func (a ADC) StopContinuous() {
+	if adcContinuous.onFull == nil {
+		return // not running
+	}
+	nrf.SAADC.INTENCLR.Set(nrf.SAADC_INTENCLR_STARTED_Msk | nrf.SAADC_INTENCLR_END_Msk)
+	adcContinuous.ppi.Disable()
+	adcContinuous.ppi.Release()
+
+	nrf.SAADC.TASKS_STOP.Set(1)
+	for nrf.SAADC.EVENTS_STOPPED.Get() == 0 {
+	}
+	nrf.SAADC.EVENTS_STOPPED.Set(0)
+	nrf.SAADC.EVENTS_STARTED.Set(0)
+	nrf.SAADC.EVENTS_END.Set(0)
+
+	// Go back to sampling on the SAMPLE task, as used by Get.
+	nrf.SAADC.SAMPLERATE.Set(nrf.SAADC_SAMPLERATE_MODE_Task << nrf.SAADC_SAMPLERATE_MODE_Pos)
+	nrf.SAADC.ENABLE.Set(nrf.SAADC_ENABLE_ENABLE_Disabled << nrf.SAADC_ENABLE_ENABLE_Pos)
+
+	adcContinuous.bufs = [2][]uint16{}
+	adcContinuous.onFull = nil
+}
+
+// adcScanTimer is the timer that triggers the conversions of a background scan.
+var adcScanTimer = nrf.TIMER2
+
+// State of a background scan started with StartADCScan.
+var adcScan struct {
+	count    int                    // number of scanned inputs, zero if not running
+	channels [8]uint8               // analog input of every SAADC channel
+	results  [8]int16               // results of the last scan, written by EasyDMA
+	latest   [8]volatile.Register16 // latest value of every analog input
+	ppi      [2]PPIChannel
+}
+
+// StartADCScan starts converting the given ADC pins in the background, rate
+// times per second, so that the latest value of each can be read without
+// blocking using ADC.Latest. Every pin is converted with the settings set
+// with ADC.SetConfig, except that oversampling and limits are not supported in
+// a scan. The rate must be between 1Hz and 10kHz.
+//
+// All inputs are converted one after the other on every trigger, using the
+// scan mode of the SAADC, so a scan takes the acquisition time plus about 2µs
+// for every pin. The trigger comes from TIMER2 through PPI, and the CPU is
+// only woken to copy the results, once per scan. While a scan is running, Get
+// returns the same value as Latest, and StartContinuous returns ErrBusInUse.
+func StartADCScan(pins []Pin, rate uint32) error {
+	if len(pins) == 0 || len(pins) > 8 || rate == 0 || rate > 10000 {
+		return ErrInvalidConfig
+	}
+	if adcContinuous.onFull != nil || adcScan.count != 0 || adcVDDSample.done != nil {
+		return ErrBusInUse
+	}
+	var channels [8]uint8
+	for i, pin := range pins {
+		ch := ADC{pin}.channel()
+		if ch < 0 {
+			return ErrInvalidInputPin
+		}
+		channels[i] = uint8(ch)
+	}
+
+	sample, err := AllocatePPIChannel()
+	if err != nil {
+		return err
+	}
+	restart, err := AllocatePPIChannel()
+	if err != nil {
+		sample.Release()
+		return err
+	}
+
+	nrf.SAADC.RESOLUTION.Set(nrf.SAADC_RESOLUTION_VAL_12bit)
+	nrf.SAADC.OVERSAMPLE.Set(0)
+	nrf.SAADC.ENABLE.Set(nrf.SAADC_ENABLE_ENABLE_Enabled << nrf.SAADC_ENABLE_ENABLE_Pos)
+	for i := 0; i < 8; i++ {
+		nrf.SAADC.CH[i].PSELN.Set(nrf.SAADC_CH_PSELP_PSELP_NC)
+		nrf.SAADC.CH[i].PSELP.Set(nrf.SAADC_CH_PSELP_PSELP_NC)
+	}
+	for i := range pins {
+		ch := uint32(channels[i])
+		nrf.SAADC.CH[i].CONFIG.Set(((nrf.SAADC_CH_CONFIG_RESP_Bypass << nrf.SAADC_CH_CONFIG_RESP_Pos) & nrf.SAADC_CH_CONFIG_RESP_Msk) |
+			((nrf.SAADC_CH_CONFIG_RESP_Bypass << nrf.SAADC_CH_CONFIG_RESN_Pos) & nrf.SAADC_CH_CONFIG_RESN_Msk) |
+			adcConfigs[ch].configValue() |
+			((nrf.SAADC_CH_CONFIG_MODE_SE << nrf.SAADC_CH_CONFIG_MODE_Pos) & nrf.SAADC_CH_CONFIG_MODE_Msk))
+		nrf.SAADC.CH[i].PSELP.Set(nrf.SAADC_CH_PSELP_PSELP_AnalogInput0 + ch)
+	}
+
+	adcScan.count = len(pins)
+	adcScan.channels = channels
+	adcScan.ppi = [2]PPIChannel{sample, restart}
+	nrf.SAADC.RESULT.PTR.Set(uint32(uintptr(unsafe.Pointer(&adcScan.results[0]))))
+	nrf.SAADC.RESULT.MAXCNT.Set(uint32(len(pins)))
+
+	// The timer triggers a scan of all channels, and the end of a scan
+	// restarts the SAADC in the same buffer, ready for the next trigger.
+	sample.Connect(&adcScanTimer.EVENTS_COMPARE[0], &nrf.SAADC.TASKS_SAMPLE)
+	sample.Enable()
+	restart.Connect(&nrf.SAADC.EVENTS_END, &nrf.SAADC.TASKS_START)
+	restart.Enable()
+
+	nrf.SAADC.EVENTS_END.Set(0)
+	nrf.SAADC.EVENTS_STARTED.Set(0)
+	nrf.SAADC.TASKS_START.Set(1)
+	for nrf.SAADC.EVENTS_STARTED.Get() == 0 {
+	}
+	nrf.SAADC.EVENTS_STARTED.Set(0)
+	nrf.SAADC.INTENSET.Set(nrf.SAADC_INTENSET_END_Msk)
+	enableADCInterrupt()
+
+	// Run the timer at 1MHz and restart it on every compare event.
+	adcScanTimer.MODE.Set(nrf.TIMER_MODE_MODE_Timer)
+	adcScanTimer.BITMODE.Set(nrf.TIMER_BITMODE_BITMODE_32Bit)
+	adcScanTimer.PRESCALER.Set(4)
+	adcScanTimer.CC[0].Set(1000000 / rate)
+	adcScanTimer.SHORTS.Set(nrf.TIMER_SHORTS_COMPARE0_CLEAR_Msk)
+	adcScanTimer.TASKS_CLEAR.Set(1)
+	adcScanTimer.TASKS_START.Set(1)
+	return nil
+}
+
+// StopADCScan stops a background scan started with StartADCScan. The values
+// returned by Latest are kept.
+func StopADCScan() {
+	if adcScan.count == 0 {
+		return // not running
+	}
+	adcScanTimer.TASKS_STOP.Set(1)
+	adcScanTimer.SHORTS.Set(0)
+	nrf.SAADC.INTENCLR.Set(nrf.SAADC_INTENCLR_END_Msk)
+	adcScan.ppi[0].Release()
+	adcScan.ppi[1].Release()
+
+	nrf.SAADC.TASKS_STOP.Set(1)
+	for nrf.SAADC.EVENTS_STOPPED.Get() == 0 {
+	}
+	nrf.SAADC.EVENTS_STOPPED.Set(0)
+	nrf.SAADC.EVENTS_STARTED.Set(0)
+	nrf.SAADC.EVENTS_END.Set(0)
+	nrf.SAADC.ENABLE.Set(nrf.SAADC_ENABLE_ENABLE_Disabled << nrf.SAADC_ENABLE_ENABLE_Pos)
+	adcScan.count = 0
+}
+
+// Latest returns the most recent value of this ADC pin converted by a
+// background scan, in the same range as Get, without blocking. It returns 0
+// if the pin hasn't been scanned yet.
+func (a ADC) Latest() uint16 {
+	ch := a.channel()
+	if ch < 0 {
+		return 0
+	}
+	return adcScan.latest[ch].Get()
+}
+
+// State of a VDD conversion armed with SampleVDDOnEvent.
+var adcVDDSample struct {
+	done   func(millivolts uint32)
+	result int16 // written by EasyDMA
+	ppi    PPIChannel
+}
+
+// SampleVDDOnEvent arms the SAADC to convert the supply voltage VDD when the
+// given event happens, and calls done with the voltage in millivolts from the
+// SAADC interrupt. The event starts the conversion through PPI, so it starts
+// at the moment of the event (within the acquisition time of 3µs) even when
+// the CPU is sleeping or busy. This makes it possible to measure a battery
+// under load: for example, &nrf.RADIO.EVENTS_READY samples the voltage when
+// the radio starts transmitting, when a coin cell sags the most. Any event
+// register works, such as a GPIOTE event or a TIMER compare event after a
+// load is switched on.
+//
+// Only one conversion is done; call it again from done for the next one, or
+// call CancelVDDSample to disarm it before the event happens. While it is
+// armed, the SAADC can't be used for anything else: StartContinuous and
+// StartADCScan return ErrBusInUse, and Get must not be called.
+func SampleVDDOnEvent(event *volatile.Register32, done func(millivolts uint32)) error {
+	if event == nil || done == nil {
+		return ErrInvalidConfig
+	}
+	if adcContinuous.onFull != nil || adcScan.count != 0 || adcVDDSample.done != nil {
+		return ErrBusInUse
+	}
+	ppi, err := AllocatePPIChannel()
+	if err != nil {
+		return err
+	}
+	adcVDDSample.done = done
+	adcVDDSample.ppi = ppi
+
+	// Convert VDD with the internal reference and a gain of 1/6, for a range
+	// of 0-3.6V.
+	nrf.SAADC.RESOLUTION.Set(nrf.SAADC_RESOLUTION_VAL_12bit)
+	nrf.SAADC.OVERSAMPLE.Set(0)
+	nrf.SAADC.SAMPLERATE.Set(nrf.SAADC_SAMPLERATE_MODE_Task << nrf.SAADC_SAMPLERATE_MODE_Pos)
+	nrf.SAADC.ENABLE.Set(nrf.SAADC_ENABLE_ENABLE_Enabled << nrf.SAADC_ENABLE_ENABLE_Pos)
+	for i := 0; i < 8; i++ {
+		nrf.SAADC.CH[i].PSELN.Set(nrf.SAADC_CH_PSELP_PSELP_NC)
+		nrf.SAADC.CH[i].PSELP.Set(nrf.SAADC_CH_PSELP_PSELP_NC)
+	}
+	config := ADCConfig{Reference: ADCReferenceInternal, Gain: ADCGain1_6}
+	nrf.SAADC.CH[0].CONFIG.Set(((nrf.SAADC_CH_CONFIG_RESP_Bypass << nrf.SAADC_CH_CONFIG_RESP_Pos) & nrf.SAADC_CH_CONFIG_RESP_Msk) |
+		((nrf.SAADC_CH_CONFIG_RESP_Bypass << nrf.SAADC_CH_CONFIG_RESN_Pos) & nrf.SAADC_CH_CONFIG_RESN_Msk) |
+		config.configValue() |
+		((nrf.SAADC_CH_CONFIG_MODE_SE << nrf.SAADC_CH_CONFIG_MODE_Pos) & nrf.SAADC_CH_CONFIG_MODE_Msk))
+	nrf.SAADC.CH[0].PSELP.Set(nrf.SAADC_CH_PSELP_PSELP_VDD)
+
+	nrf.SAADC.RESULT.PTR.Set(uint32(uintptr(unsafe.Pointer(&adcVDDSample.result))))
+	nrf.SAADC.RESULT.MAXCNT.Set(1)
+	nrf.SAADC.EVENTS_END.Set(0)
+	nrf.SAADC.EVENTS_STARTED.Set(0)
+	nrf.SAADC.TASKS_START.Set(1)
+	for nrf.SAADC.EVENTS_STARTED.Get() == 0 {
+	}
+	nrf.SAADC.EVENTS_STARTED.Set(0)
+	nrf.SAADC.INTENSET.Set(nrf.SAADC_INTENSET_END_Msk)
+	enableADCInterrupt()
+
+	ppi.Connect(event, &nrf.SAADC.TASKS_SAMPLE)
+	ppi.Enable()
+	return nil
+}
+
+// CancelVDDSample disarms a conversion armed with SampleVDDOnEvent, without
+// calling its callback. It does nothing if no conversion is armed.
+func CancelVDDSample() {
+	mask := interrupt.Disable()
+	defer interrupt.Restore(mask)
+	if adcVDDSample.done != nil {
+		stopVDDSample()
+	}
+}
+
+// stopVDDSample stops and disables the SAADC after SampleVDDOnEvent.
+func stopVDDSample() {
+	adcVDDSample.ppi.Release()
+	nrf.SAADC.INTENCLR.Set(nrf.SAADC_INTENCLR_END_Msk)
+	nrf.SAADC.TASKS_STOP.Set(1)
+	for nrf.SAADC.EVENTS_STOPPED.Get() == 0 {
+	}
+	nrf.SAADC.EVENTS_STOPPED.Set(0)
+	nrf.SAADC.EVENTS_END.Set(0)
+	nrf.SAADC.ENABLE.Set(nrf.SAADC_ENABLE_ENABLE_Disabled << nrf.SAADC_ENABLE_ENABLE_Pos)
+	adcVDDSample.done = nil
+}
+
+// Limits of every analog input, as set with ADC.SetLimits.
+var adcLimits [8]struct {
+	low, high uint16
+	callback  func()
+}
+
+// The limit callback of the analog input that is currently being sampled.
+var adcLimitCallback func()
+
+// SetLimits sets a low and a high limit for this ADC pin, in the same range as
+// the values returned by Get. The callback is called from the SAADC interrupt
+// whenever a sample is below low or above high, so it is called for every
+// such sample until the value is within the limits again. A low limit of 0 or
+// a high limit of 0xffff disables that limit, so both can be used on their own.
+// A nil callback disables both.
+//
+// The limits are only checked while the SAADC is sampling this pin, so they
+// are most useful with StartContinuous: with long buffers the CPU can sleep
+// most of the time and is only woken when a buffer is full or a limit is
+// crossed.
+func (a ADC) SetLimits(low, high uint16, callback func()) error {
+	ch := a.channel()
+	if ch < 0 {
+		return ErrInvalidInputPin
+	}
+	if low > high {
+		return ErrInvalidConfig
+	}
+	adcLimits[ch].low = low
+	adcLimits[ch].high = high
+	adcLimits[ch].callback = callback
+	return nil
+}
+
+// adcSetLimits configures the limits of SAADC channel 0 for analog input ch.
+func adcSetLimits(ch int) {
+	limits := adcLimits[ch]
+	lowLimit, highLimit := int16(-0x8000), int16(0x7fff)
+	var inten uint32
+	if limits.low != 0 {
+		lowLimit = int16(limits.low >> 4)
+		inten |= nrf.SAADC_INTENSET_CH0LIMITL_Msk
+	}
+	if limits.high != 0xffff {
+		highLimit = int16(limits.high >> 4)
+		inten |= nrf.SAADC_INTENSET_CH0LIMITH_Msk
+	}
+	nrf.SAADC.CH[0].LIMIT.Set((uint32(uint16(lowLimit)) << nrf.SAADC_CH_LIMIT_LOW_Pos) |
+		(uint32(uint16(highLimit)) << nrf.SAADC_CH_LIMIT_HIGH_Pos))
+
+	nrf.SAADC.INTENCLR.Set(nrf.SAADC_INTENCLR_CH0LIMITL_Msk | nrf.SAADC_INTENCLR_CH0LIMITH_Msk)
+	nrf.SAADC.EVENTS_CH[0].LIMITL.Set(0)
+	nrf.SAADC.EVENTS_CH[0].LIMITH.Set(0)
+	adcLimitCallback = limits.callback
+	if limits.callback != nil && inten != 0 {
+		nrf.SAADC.INTENSET.Set(inten)
+		enableADCInterrupt()
+	}
+}
+
+// enableADCInterrupt enables the SAADC interrupt, used for continuous capture,
+// background scans and limits.
+func enableADCInterrupt() {
+	intr := interrupt.New(nrf.IRQ_SAADC, func(interrupt.Interrupt) {
+		handleADCInterrupt()
+	})
+	intr.SetPriority(interruptPriorityLow)
+	intr.Enable()
+}
+
+// handleADCInterrupt handles the SAADC interrupt.
+func handleADCInterrupt() {
+	if nrf.SAADC.EVENTS_CH[0].LIMITL.Get() != 0 || nrf.SAADC.EVENTS_CH[0].LIMITH.Get() != 0 {
+		nrf.SAADC.EVENTS_CH[0].LIMITL.Set(0)
+		nrf.SAADC.EVENTS_CH[0].LIMITH.Set(0)
+		if adcLimitCallback != nil {
+			adcLimitCallback()
+		}
+	}
+
+	if adcVDDSample.done != nil {
+		if nrf.SAADC.EVENTS_END.Get() != 0 {
+			// Convert the 12-bit result of the 0-3.6V range to millivolts.
+			v := adcVDDSample.result
+			if v < 0 {
+				v = 0
+			}
+			done := adcVDDSample.done
+			stopVDDSample()
+			done(uint32(v) * 3600 / 4096)
+		}
+		return
+	}
+
+	if adcScan.count != 0 {
+		if nrf.SAADC.EVENTS_END.Get() != 0 {
+			nrf.SAADC.EVENTS_END.Set(0)
+			for i, v := range adcScan.results[:adcScan.count] {
+				if v < 0 {
+					v = 0
+				}
+				adcScan.latest[adcScan.channels[i]].Set(uint16(v) << 4)
+			}
+		}
+		return
+	}
+	if adcContinuous.onFull == nil {
+		// Get polls the events itself.
+		return
+	}
+	if nrf.SAADC.EVENTS_END.Get() != 0 {
+		nrf.SAADC.EVENTS_END.Set(0)
+		full := adcContinuous.bufs[adcContinuous.filling]
+		adcContinuous.filling ^= 1
+		for i, v := range full {
+			// Convert the signed 12-bit result to the range used by Get.
+			if int16(v) < 0 {
+				v = 0
+			}
+			full[i] = v << 4
+		}
+		adcContinuous.onFull(full)
+	}
+	if nrf.SAADC.EVENTS_STARTED.Get() != 0 {
+		nrf.SAADC.EVENTS_STARTED.Set(0)
+		// The hardware latched the pointer of the buffer that is now being
+		// filled, so set the pointer for the one after it.
+		next := adcContinuous.bufs[adcContinuous.filling^1]
+		nrf.SAADC.RESULT.PTR.Set(uint32(uintptr(unsafe.Pointer(&next[0]))))
+	}
+}
+
+// PartNumber returns the part number of the chip from the FICR, for example
+// 0x52832 or 0x52840. This allows a single build to adapt to the chip it runs
+// on, for example to only use peripherals where they exist.
+func PartNumber() uint32 {
+	return nrf.FICR.INFO.PART.Get()
+}
+
+// Variant returns the build code of the chip from the FICR, for example "AAE0".
+// It identifies the hardware revision and can be used to decide which errata
+// apply.
+func Variant() string {
+	v := nrf.FICR.INFO.VARIANT.Get()
+	return string([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+// Chip returns the name of the chip based on its part number, for example
+// "nRF52840".
+func Chip() string {
+	const hexDigits = "0123456789ABCDEF"
+	part := PartNumber()
+	name := []byte("nRF00000")
+	for i := len(name) - 1; i >= 3; i-- {
+		name[i] = hexDigits[part&0xf]
+		part >>= 4
+	}
+	return string(name)
+}
+
+// PinWakeLatch returns the LATCH register of the given GPIO port. A bit is set
+// for every pin that has its sense mechanism enabled (see Pin.SetSense) and
+// met its sense condition, such as a pin that woke the chip from sleep through
+// the PORT event. The bits stay set until cleared with ClearPinWakeLatch, even
+// when the pin no longer meets the condition. Use LatchedPin to find the pin.
+func PinWakeLatch(port uint8) uint32 {
+	return getPort(port).LATCH.Get()
+}
+
+// ClearPinWakeLatch clears the latch bits of port given in mask.
+func ClearPinWakeLatch(port uint8, mask uint32) {
+	getPort(port).LATCH.Set(mask)
+}
+
+// LatchedPin returns the lowest numbered pin of port that is set in the latch
+// value returned by PinWakeLatch. It returns false if no bit is set.
+func LatchedPin(port uint8, latch uint32) (Pin, bool) {
+	for i := uint8(0); i < 32; i++ {
+		if latch&(1<<i) != 0 {
+			return Pin(port*32 + i), true
+		}
+	}
+	return NoPin, false
+}
+
+// bootloaderAddress returns the start address of the bootloader as recorded in
+// the UICR, or 0xffffffff when there is none. The nrf52 has no separate
+// register for it: the MBR and bootloaders use the first NRFFW register.
+func bootloaderAddress() uint32 {
+	return nrf.UICR.NRFFW[0].Get()
+}
+
+// resetPeripherals resets the chip specific peripherals for ResetPeripherals:
+// the periodic SPI transfers, the square wave, the pulse counter, the PPS
+// output, the SAADC (including an armed VDD conversion) and the PWM
+// peripherals.
+func resetPeripherals() {
+	SPI0.StopTrigger()
+	SPI1.StopTrigger()
+	if squareWave.running {
+		squareWave.pin.StopSquareWave()
+	}
+	StopADCScan()
+	ADC{}.StopContinuous()
+	CancelVDDSample()
+	PulseCounter{}.Stop()
+	StopPPS()
+	nrf.SAADC.INTENCLR.Set(nrf.SAADC_INTENCLR_CH0LIMITL_Msk | nrf.SAADC_INTENCLR_CH0LIMITH_Msk)
+	for i := range adcLimits {
+		adcLimits[i].callback = nil // disables the limits
+	}
+	adcLimitCallback = nil
+
+	for i, p := range pwms {
+		if p.ENABLE.Get() != 0 {
+			p.TASKS_STOP.Set(1)
+			for p.EVENTS_STOPPED.Get() == 0 {
+			}
+			p.EVENTS_STOPPED.Set(0)
+			p.ENABLE.Set(nrf.PWM_ENABLE_ENABLE_Disabled << nrf.PWM_ENABLE_ENABLE_Pos)
+		}
+		for j := range p.PSEL.OUT {
+			p.PSEL.OUT[j].Set(pselDisconnected)
+		}
+		pwmChannelPins[i] = 0xFFFFFFFF
+	}
+}
+
+// Limits of the COUNTERTOP register of the PWM peripheral.
+const (
+	pwmMinTop = 3
+	pwmMaxTop = 32767
+)
+
+// pwmTolerance is the largest relative difference between the requested and
+// the achieved PWM frequency that SetFrequencyDuty accepts (1/100, or 1%).
+const pwmTolerance = 100
+
+// SetFrequencyDuty outputs a PWM signal with the given frequency in Hz on the
+// pin, which is high for the given fraction (from 0 to 1) of every period. For
+// example, SetFrequencyDuty(25000, 0.4) outputs 25kHz at 40% duty cycle, as
+// used by 4-pin fans.
+//
+// The PWM runs from a 16MHz clock divided by a prescaler. The smallest
+// prescaler that fits the period is used, as it gives the finest resolution:
+// frequencies that divide 16MHz (or 8MHz, 4MHz and so on for lower
+// frequencies) are exact, others are rounded to the nearest achievable one.
+// The duty cycle resolution is one clock of the period, so it gets coarser at
+// high frequencies: 25kHz has 640 steps.
+//
+// Frequencies from 4Hz up to 5.33MHz (16MHz/3) are supported, as long as the
+// achieved frequency is within 1% of the requested one. That holds for any
+// frequency up to 320kHz, but above it the achievable frequencies get sparse:
+// 16MHz/3, 16MHz/4 and so on. ErrInvalidConfig is returned for other
+// frequencies and for a duty cycle outside 0-1.
+//
+// Like Set, this uses one PWM peripheral per pin and returns ErrNoFreePWM if
+// all of them are in use. Calling Set afterwards changes the frequency back to
+// the one Set uses.
+func (pwm PWM) SetFrequencyDuty(freq uint32, duty float32) error {
+	if !(duty >= 0 && duty <= 1) {
+		return ErrInvalidConfig
+	}
+	prescaler, top, err := pwmTiming(freq)
+	if err != nil {
+		return err
+	}
+	for i := range pwms {
+		if pwmChannelPins[i] != 0xFFFFFFFF && pwmChannelPins[i] != uint32(pwm.Pin) {
+			continue
+		}
+		pwmChannelPins[i] = uint32(pwm.Pin)
+		compare := uint16(duty*float32(top) + 0.5)
+		pwmChannelSequence[i] = compare | 0x8000 // set bit 15 to invert polarity
+
+		p := pwms[i]
+		for j := range p.PSEL.OUT {
+			p.PSEL.OUT[j].Set(uint32(pwm.Pin))
+		}
+		p.ENABLE.Set(nrf.PWM_ENABLE_ENABLE_Enabled << nrf.PWM_ENABLE_ENABLE_Pos)
+		p.PRESCALER.Set(prescaler)
+		p.MODE.Set(nrf.PWM_MODE_UPDOWN_Up)
+		p.COUNTERTOP.Set(top)
+		p.LOOP.Set(0)
+		p.DECODER.Set((nrf.PWM_DECODER_LOAD_Common << nrf.PWM_DECODER_LOAD_Pos) | (nrf.PWM_DECODER_MODE_RefreshCount << nrf.PWM_DECODER_MODE_Pos))
+		p.SEQ[0].PTR.Set(uint32(uintptr(unsafe.Pointer(&pwmChannelSequence[i]))))
+		p.SEQ[0].CNT.Set(1)
+		p.SEQ[0].REFRESH.Set(1)
+		p.SEQ[0].ENDDELAY.Set(0)
+		p.TASKS_SEQSTART[0].Set(1)
+		return nil
+	}
+	return ErrNoFreePWM
+}
+
+// pwmTiming returns the PRESCALER and COUNTERTOP values for the given PWM
+// frequency in Hz, using the smallest prescaler that fits the period. It returns
+// ErrInvalidConfig if the achieved frequency is off by more than pwmTolerance.
+func pwmTiming(freq uint32) (prescaler, top uint32, err error) {
+	if freq == 0 {
+		return 0, 0, ErrInvalidConfig
+	}
+	for prescaler = nrf.PWM_PRESCALER_PRESCALER_DIV_1; prescaler <= nrf.PWM_PRESCALER_PRESCALER_DIV_128; prescaler++ {
+		clock := uint32(16000000) >> prescaler
+		top = (clock + freq/2) / freq
+		if top < pwmMinTop {
+			break // too fast, and it only gets worse with higher prescalers
+		}
+		if top <= pwmMaxTop {
+			// The achieved frequency is clock/top, compare it with freq.
+			want := uint64(top) * uint64(freq)
+			diff := want - uint64(clock)
+			if want < uint64(clock) {
+				diff = uint64(clock) - want
+			}
+			if diff*pwmTolerance > want {
+				break
+			}
+			return prescaler, top, nil
+		}
+	}
+	return 0, 0, ErrInvalidConfig
+}
@@ -0,0 +1,63 @@
+// +build nrf52 nrf52833 nrf52840
+
+package machine
+
+import (
+	"device/nrf"
+	"runtime/interrupt"
+)
+
+var powerFailHandler func()
+
+// SetPowerFailHandler enables the power-fail comparator, which calls callback
+// from an interrupt when the supply voltage drops below the given threshold in
+// volts. This gives the application a chance to save its state before the
+// supply collapses, for example on a supercap or battery backed device. The
+// threshold is rounded to 0.1V and must be between 1.7V and 2.8V, otherwise
+// ErrInvalidConfig is returned. Pass a nil callback to disable the comparator.
+//
+// The time left after the callback is called depends on the supply: size the
+// capacitance so that it covers the worst-case time of the work done in the
+// callback. Flash writes in particular need a stable supply until they
+// complete. On the nrf52833 and nrf52840 the threshold is compared to VDD; the
+// separate threshold of the VDDH supply is not configured.
+//
+// The power-fail comparator is part of the POWER peripheral, which is owned by
+// the SoftDevice while it is enabled: use its power-fail API instead.
+func SetPowerFailHandler(threshold float32, callback func()) error {
+	if callback == nil {
+		nrf.POWER.INTENCLR.Set(nrf.POWER_INTENCLR_POFWARN_Msk)
+		nrf.POWER.POFCON.Set(0)
+		powerFailHandler = nil
+		return nil
+	}
+	tenths := uint32(threshold*10 + 0.5)
+	if threshold < 0 || tenths < 17 || tenths > 28 {
+		return ErrInvalidConfig
+	}
+	// THRESHOLD is 4 for 1.7V and increases by one for every 0.1V, up to
+	// 15 for 2.8V.
+	value := tenths - 17 + nrf.POWER_POFCON_THRESHOLD_V17
+
+	powerFailHandler = callback
+	nrf.POWER.EVENTS_POFWARN.Set(0)
+	nrf.POWER.POFCON.Set((nrf.POWER_POFCON_POF_Enabled << nrf.POWER_POFCON_POF_Pos) |
+		((value << nrf.POWER_POFCON_THRESHOLD_Pos) & nrf.POWER_POFCON_THRESHOLD_Msk))
+	nrf.POWER.INTENSET.Set(nrf.POWER_INTENSET_POFWARN_Msk)
+
+	intr := interrupt.New(nrf.IRQ_POWER_CLOCK, handlePowerInterrupt)
+	intr.SetPriority(interruptPriorityHigh) // there is little time left
+	intr.Enable()
+	return nil
+}
+
+// handlePowerInterrupt handles the interrupt of the POWER and CLOCK
+// peripherals.
+func handlePowerInterrupt(interrupt.Interrupt) {
+	if nrf.POWER.EVENTS_POFWARN.Get() != 0 {
+		nrf.POWER.EVENTS_POFWARN.Set(0)
+		if powerFailHandler != nil {
+			powerFailHandler()
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// +build nrf52 nrf52833 nrf52840
+
+package machine
+
+import (
+	"device/nrf"
+	"runtime/interrupt"
+	"runtime/volatile"
+)
+
+// QDEC is the quadrature decoder of the nrf52, which decodes the A and B
+// signals of a rotary encoder in hardware. It samples the inputs at a fixed
+// rate and accumulates the steps, so the CPU doesn't need to handle every edge.
+type QDEC struct {
+	Bus *nrf.QDEC_Type
+}
+
+// QDEC0 is the only quadrature decoder on the nrf52.
+var QDEC0 = QDEC{Bus: nrf.QDEC}
+
+// QDECConfig is used to store config info for the quadrature decoder.
+type QDECConfig struct {
+	// A and B are the pins of the two phases of the encoder. They are
+	// configured as inputs with pullup, for a mechanical encoder that
+	// connects them to ground.
+	A Pin
+	B Pin
+
+	// SamplePeriod is the time between samples in microseconds: 128 times a
+	// power of two, up to 131072 (131ms). The zero value means 1024µs. The
+	// encoder must not make more than one step per sample period, so a fast
+	// knob needs a short period.
+	SamplePeriod uint32
+
+	// ReportPeriod is the number of samples after which the accumulated steps
+	// are reported to the callback: 10, 40, 80, 120, 160, 200, 240 or 280, or
+	// 1 to report after every sample. The zero value means 10.
+	ReportPeriod uint16
+
+	// Debounce enables the input debounce filters, which are needed for
+	// mechanical encoders.
+	Debounce bool
+}
+
+// Position of QDEC0 and its callback, updated on every report.
+var (
+	qdecPosition volatile.Register32
+	qdecCallback func(delta int32)
+)
+
+// Configure sets up the quadrature decoder and starts it. The position returned
+// by Position starts at zero.
+func (q QDEC) Configure(config QDECConfig) error {
+	if config.A == NoPin || config.B == NoPin {
+		return ErrNoPin
+	}
+	sampleper := uint32(nrf.QDEC_SAMPLEPER_SAMPLEPER_1024us)
+	if config.SamplePeriod != 0 {
+		sampleper = 0
+		for period := uint32(128); period != config.SamplePeriod; period <<= 1 {
+			sampleper++
+			if sampleper > nrf.QDEC_SAMPLEPER_SAMPLEPER_131ms {
+				return ErrInvalidConfig
+			}
+		}
+	}
+	var reportper uint32
+	switch config.ReportPeriod {
+	case 0, 10:
+		reportper = nrf.QDEC_REPORTPER_REPORTPER_10Smpl
+	case 1:
+		reportper = nrf.QDEC_REPORTPER_REPORTPER_1Smpl
+	case 40, 80, 120, 160, 200, 240, 280:
+		// The values from 40 to 280 are numbered from 1.
+		reportper = uint32(config.ReportPeriod) / 40
+	default:
+		return ErrInvalidConfig
+	}
+
+	q.Bus.TASKS_STOP.Set(1)
+	q.Bus.ENABLE.Set(nrf.QDEC_ENABLE_ENABLE_Disabled)
+
+	config.A.Configure(PinConfig{Mode: PinInputPullup})
+	config.B.Configure(PinConfig{Mode: PinInputPullup})
+	q.Bus.PSEL.A.Set(uint32(config.A))
+	q.Bus.PSEL.B.Set(uint32(config.B))
+	q.Bus.PSEL.LED.Set(pselDisconnected)
+
+	q.Bus.SAMPLEPER.Set(sampleper)
+	q.Bus.REPORTPER.Set(reportper)
+	if config.Debounce {
+		q.Bus.DBFEN.Set(nrf.QDEC_DBFEN_DBFEN_Enabled)
+	} else {
+		q.Bus.DBFEN.Set(nrf.QDEC_DBFEN_DBFEN_Disabled)
+	}
+
+	// Move the accumulated steps to ACCREAD on every report, so that steps
+	// made while the interrupt runs are not lost.
+	q.Bus.SHORTS.Set(nrf.QDEC_SHORTS_REPORTRDY_READCLRACC_Msk)
+	q.Bus.EVENTS_REPORTRDY.Set(0)
+	q.Bus.INTENSET.Set(nrf.QDEC_INTENSET_REPORTRDY_Msk)
+	intr := interrupt.New(nrf.IRQ_QDEC, handleQDECInterrupt)
+	intr.SetPriority(interruptPriorityLow)
+	intr.Enable()
+
+	qdecPosition.Set(0)
+	q.Bus.ENABLE.Set(nrf.QDEC_ENABLE_ENABLE_Enabled)
+	q.Bus.TASKS_READCLRACC.Set(1)
+	q.Bus.TASKS_START.Set(1)
+	return nil
+}
+
+// SetCallback sets a callback that is called from the QDEC interrupt when the
+// encoder has moved: after every report period in which the accumulated steps
+// are not zero, with the number of steps since the previous report (its sign
+// gives the direction). The hardware only generates a report when the encoder
+// moved, so the CPU can sleep while the knob is idle. Pass nil to remove the
+// callback.
+func (q QDEC) SetCallback(callback func(delta int32)) {
+	mask := interrupt.Disable()
+	qdecCallback = callback
+	interrupt.Restore(mask)
+}
+
+// Position returns the position of the encoder in steps since Configure. It is
+// updated on every report, so it lags the encoder by up to one report period.
+func (q QDEC) Position() int32 {
+	return int32(qdecPosition.Get())
+}
+
+// Stop stops the quadrature decoder and disables it, so that it no longer
+// draws current. The position is kept.
+func (q QDEC) Stop() {
+	q.Bus.INTENCLR.Set(nrf.QDEC_INTENCLR_REPORTRDY_Msk)
+	q.Bus.TASKS_STOP.Set(1)
+	q.Bus.ENABLE.Set(nrf.QDEC_ENABLE_ENABLE_Disabled)
+}
+
+// handleQDECInterrupt handles the REPORTRDY event of the QDEC.
+func handleQDECInterrupt(interrupt.Interrupt) {
+	if nrf.QDEC.EVENTS_REPORTRDY.Get() == 0 {
+		return
+	}
+	nrf.QDEC.EVENTS_REPORTRDY.Set(0)
+	delta := int32(nrf.QDEC.ACCREAD.Get())
+	qdecPosition.Set(uint32(int32(qdecPosition.Get()) + delta))
+	if qdecCallback != nil && delta != 0 {
+		qdecCallback(delta)
+	}
+}
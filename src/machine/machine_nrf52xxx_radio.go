@@ -0,0 +1,134 @@
+// +build nrf52 nrf52833 nrf52840
+// +build !softdevice
+
+package machine
+
+import (
+	"device/nrf"
+	"errors"
+	"unsafe"
+)
+
+var (
+	ErrRadioPacketSize = errors.New("machine: radio packet too large")
+	ErrRadioCRC        = errors.New("machine: radio packet received with CRC error")
+)
+
+// RadioMaxPacketSize is the maximum payload size of a single radio packet.
+const RadioMaxPacketSize = 32
+
+// Radio is the 2.4GHz radio of the nrf52, used in a simple proprietary
+// (non-BLE) packet mode. Two boards configured with the same channel and
+// address can send fixed size packets to each other.
+//
+// The radio cannot be used together with the SoftDevice, which needs exclusive
+// access to it. Therefore it is not available on SoftDevice targets.
+type Radio struct {
+	Bus *nrf.RADIO_Type
+}
+
+// Radio0 is the only radio on the nrf52.
+var Radio0 = Radio{Bus: nrf.RADIO}
+
+// RadioConfig is used to store config info for the radio.
+type RadioConfig struct {
+	// Channel sets the frequency of the radio to 2400MHz + Channel MHz. It
+	// must be in the range 0..100.
+	Channel uint8
+
+	// Address is the 4-byte base address of the packets. Only packets with the
+	// same address are received.
+	Address uint32
+
+	// Prefix is the address prefix byte, sent before the base address.
+	Prefix uint8
+}
+
+// radioHFXORequested is set once the radio has requested the HFXO.
+var radioHFXORequested bool
+
+// Packet buffer used by EasyDMA: the first byte is the length of the payload.
+var radioPacket [1 + RadioMaxPacketSize]byte
+
+// Configure sets up the radio for sending and receiving packets with the given
+// configuration. It also starts the external high frequency crystal, which is
+// required by the radio.
+func (r Radio) Configure(config RadioConfig) error {
+	if config.Channel > 100 {
+		return ErrInvalidConfig
+	}
+
+	// The radio needs the external crystal oscillator. It is requested only
+	// once, even if the radio is reconfigured.
+	if !radioHFXORequested {
+		radioHFXORequested = true
+		RequestHFXO()
+	}
+
+	r.Bus.POWER.Set(nrf.RADIO_POWER_POWER_Enabled)
+	r.Bus.MODE.Set(nrf.RADIO_MODE_MODE_Nrf_2Mbit)
+	r.Bus.TXPOWER.Set(nrf.RADIO_TXPOWER_TXPOWER_0dBm)
+	r.Bus.FREQUENCY.Set(uint32(config.Channel))
+	r.Bus.DATAWHITEIV.Set(uint32(config.Channel))
+
+	// Packet layout: an 8-bit length field followed by the payload.
+	r.Bus.PCNF0.Set(8 << nrf.RADIO_PCNF0_LFLEN_Pos)
+	r.Bus.PCNF1.Set(RadioMaxPacketSize<<nrf.RADIO_PCNF1_MAXLEN_Pos |
+		4<<nrf.RADIO_PCNF1_BALEN_Pos | // 4 byte base address + 1 byte prefix
+		nrf.RADIO_PCNF1_ENDIAN_Big<<nrf.RADIO_PCNF1_ENDIAN_Pos |
+		nrf.RADIO_PCNF1_WHITEEN_Enabled<<nrf.RADIO_PCNF1_WHITEEN_Pos)
+
+	// Use logical address 0 for both sending and receiving.
+	r.Bus.BASE0.Set(config.Address)
+	r.Bus.PREFIX0.Set(uint32(config.Prefix))
+	r.Bus.TXADDRESS.Set(0)
+	r.Bus.RXADDRESSES.Set(nrf.RADIO_RXADDRESSES_ADDR0)
+
+	// 16-bit CRC (CCITT).
+	r.Bus.CRCCNF.Set(nrf.RADIO_CRCCNF_LEN_Two << nrf.RADIO_CRCCNF_LEN_Pos)
+	r.Bus.CRCPOLY.Set(0x11021)
+	r.Bus.CRCINIT.Set(0xffff)
+
+	r.Bus.PACKETPTR.Set(uint32(uintptr(unsafe.Pointer(&radioPacket[0]))))
+
+	// Start the transfer as soon as the radio is ready, and disable it again
+	// when the packet has been sent or received.
+	r.Bus.SHORTS.Set(nrf.RADIO_SHORTS_READY_START | nrf.RADIO_SHORTS_END_DISABLE)
+
+	return nil
+}
+
+// Send transmits a single packet and blocks until it has been sent. Note that
+// there is no acknowledgement: the packet may not have been received.
+func (r Radio) Send(data []byte) error {
+	if len(data) > RadioMaxPacketSize {
+		return ErrRadioPacketSize
+	}
+	radioPacket[0] = byte(len(data))
+	copy(radioPacket[1:], data)
+
+	r.Bus.EVENTS_DISABLED.Set(0)
+	r.Bus.TASKS_TXEN.Set(1)
+	for r.Bus.EVENTS_DISABLED.Get() == 0 {
+	}
+	return nil
+}
+
+// Receive blocks until a packet has been received and copies its payload into
+// data. It returns the number of bytes copied, which may be less than the
+// payload size if data is too small.
+func (r Radio) Receive(data []byte) (int, error) {
+	r.Bus.EVENTS_DISABLED.Set(0)
+	r.Bus.TASKS_RXEN.Set(1)
+	for r.Bus.EVENTS_DISABLED.Get() == 0 {
+	}
+
+	if r.Bus.CRCSTATUS.Get() != nrf.RADIO_CRCSTATUS_CRCSTATUS_CRCOk {
+		return 0, ErrRadioCRC
+	}
+	n := int(radioPacket[0])
+	if n > RadioMaxPacketSize {
+		n = RadioMaxPacketSize
+	}
+	return copy(data, radioPacket[1:1+n]), nil
+}
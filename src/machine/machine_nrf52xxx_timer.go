@@ -0,0 +1,241 @@
+// +build nrf52 nrf52833 nrf52840
+
+package machine
+
+import (
+	"device/nrf"
+	"errors"
+	"runtime/interrupt"
+)
+
+var ErrNoFreeTimer = errors.New("machine: all software timers are in use")
+
+// maxTimers is the number of software timers that can be active at the same
+// time.
+const maxTimers = 32
+
+// maxTimerInterval is the limit of the interval of a software timer in RTC
+// ticks (about 4 minutes), which is half the range of the 24-bit RTC counter.
+// Counter values up to this far behind are considered to be in the past.
+const maxTimerInterval = 1 << 23
+
+// TimerHandle identifies a software timer started with AddTimer. The zero
+// value is not a valid timer.
+type TimerHandle uint8
+
+type softTimer struct {
+	interval uint32 // in RTC ticks, zero if the timer is unused
+	next     uint32 // counter value of the next expiry
+	callback func()
+}
+
+var (
+	softTimers [maxTimers]softTimer
+	rtc2Init   bool
+)
+
+// startRTC2 starts RTC2 and enables its interrupt, if that wasn't done yet. It
+// is used by the software timers (on compare register 0) and PPS (on compare
+// register 1).
+func startRTC2() {
+	if rtc2Init {
+		return
+	}
+	rtc2Init = true
+	nrf.RTC2.PRESCALER.Set(0)
+	nrf.RTC2.TASKS_START.Set(1)
+	intr := interrupt.New(nrf.IRQ_RTC2, handleRTC2)
+	intr.SetPriority(interruptPriorityLow)
+	intr.Enable()
+}
+
+// handleRTC2 handles the compare events of RTC2.
+func handleRTC2(interrupt.Interrupt) {
+	if nrf.RTC2.EVENTS_COMPARE[1].Get() != 0 {
+		nrf.RTC2.EVENTS_COMPARE[1].Set(0)
+		handlePPS()
+	}
+	if nrf.RTC2.EVENTS_COMPARE[0].Get() != 0 {
+		handleSoftTimers()
+	}
+}
+
+// AddTimer starts a periodic software timer that calls callback every interval
+// RTC ticks (see RTCFrequency and NanosecondsToTicks), until it is canceled.
+// The callback is called from an interrupt, so it must be short and must not
+// block.
+//
+// All software timers share a single compare register of the RTC2
+// peripheral, which keeps running while the CPU sleeps, so many application
+// timers (sensor polls, timeouts) cost no more power than a single one. Up to
+// 32 timers can be active at a time; AddTimer returns ErrNoFreeTimer when
+// they are all in use. The interval must be between 2 ticks and about 4
+// minutes, otherwise ErrInvalidConfig is returned.
+func AddTimer(interval uint32, callback func()) (TimerHandle, error) {
+	if interval < 2 || interval >= maxTimerInterval || callback == nil {
+		return 0, ErrInvalidConfig
+	}
+	startRTC2()
+
+	mask := interrupt.Disable()
+	defer interrupt.Restore(mask)
+	for i := range softTimers {
+		t := &softTimers[i]
+		if t.interval != 0 {
+			continue
+		}
+		t.interval = interval
+		t.next = (nrf.RTC2.COUNTER.Get() + interval) & 0x00ffffff
+		t.callback = callback
+		scheduleSoftTimers()
+		return TimerHandle(i + 1), nil
+	}
+	return 0, ErrNoFreeTimer
+}
+
+// Cancel stops the timer. Its callback won't be called anymore once Cancel
+// returns. Canceling a timer that was already canceled does nothing.
+func (h TimerHandle) Cancel() {
+	if h == 0 || int(h) > maxTimers {
+		return
+	}
+	mask := interrupt.Disable()
+	softTimers[h-1] = softTimer{}
+	scheduleSoftTimers()
+	interrupt.Restore(mask)
+}
+
+// timerDue returns whether the given counter value has been reached, taking
+// the wraparound of the 24-bit counter into account.
+func timerDue(next, now uint32) bool {
+	diff := (next - now) & 0x00ffffff
+	return diff == 0 || diff >= maxTimerInterval
+}
+
+// handleSoftTimers calls the callbacks of all expired timers and sets the
+// compare register for the next one.
+func handleSoftTimers() {
+	nrf.RTC2.EVENTS_COMPARE[0].Set(0)
+	now := nrf.RTC2.COUNTER.Get()
+	for i := range softTimers {
+		t := &softTimers[i]
+		if t.interval == 0 || !timerDue(t.next, now) {
+			continue
+		}
+		// Schedule the next expiry relative to the previous one, so that a
+		// late interrupt doesn't make the timer drift.
+		t.next = (t.next + t.interval) & 0x00ffffff
+		if timerDue(t.next, now) {
+			t.next = (now + t.interval) & 0x00ffffff
+		}
+		t.callback()
+	}
+	scheduleSoftTimers()
+}
+
+// scheduleSoftTimers sets the compare register of RTC2 to the first expiry of
+// all active timers, or disables the compare interrupt if there are none. It
+// must be called with interrupts disabled or from the interrupt handler.
+func scheduleSoftTimers() {
+	now := nrf.RTC2.COUNTER.Get()
+	first := uint32(0)
+	found := false
+	for i := range softTimers {
+		t := &softTimers[i]
+		if t.interval == 0 {
+			continue
+		}
+		diff := (t.next - now) & 0x00ffffff
+		if timerDue(t.next, now) {
+			diff = 0
+		}
+		if !found || diff < first {
+			first = diff
+			found = true
+		}
+	}
+	if !found {
+		nrf.RTC2.INTENCLR.Set(nrf.RTC_INTENCLR_COMPARE0)
+		return
+	}
+	// The compare event is only generated reliably if the compare value is at
+	// least 2 ticks ahead of the counter.
+	if first < 2 {
+		first = 2
+	}
+	nrf.RTC2.CC[0].Set((now + first) & 0x00ffffff)
+	nrf.RTC2.INTENSET.Set(nrf.RTC_INTENSET_COMPARE0)
+}
+
+// State of the output started with Pin.PPS.
+var pps struct {
+	running bool
+	channel GPIOTEChannel
+	ppi     PPIChannel
+}
+
+// PPS starts a one pulse per second output on the pin: a 1Hz square wave that
+// rises at the start of every second and falls half a second later. It is
+// generated by RTC2, which toggles the pin through PPI and GPIOTE on a compare
+// event every 16384 ticks of the 32.768kHz clock, so the edges have no
+// software jitter at all and the signal is as accurate as the low frequency
+// clock. The interrupt only moves the compare register forward in time, and
+// may be late by up to half a second without affecting the output. Use the
+// crystal oscillator as LFCLK source for an accurate output: the RC oscillator
+// is only accurate to a few hundred ppm.
+//
+// The first rising edge is half a second after PPS is called. The pin must be
+// configured as an output. Only one PPS output can run at a time: ErrBusInUse
+// is returned if it is already running. It needs a free GPIOTE channel and a
+// free PPI channel until StopPPS is called.
+func (p Pin) PPS() error {
+	if pps.running {
+		return ErrBusInUse
+	}
+	channel, err := AllocateGPIOTEChannel()
+	if err != nil {
+		return err
+	}
+	ppi, err := AllocatePPIChannel()
+	if err != nil {
+		channel.Release()
+		return err
+	}
+	pps.running = true
+	pps.channel = channel
+	pps.ppi = ppi
+
+	p.Low()
+	channel.ConfigureTask(p, false)
+	ppi.Connect(&nrf.RTC2.EVENTS_COMPARE[1], &nrf.GPIOTE.TASKS_OUT[channel])
+	ppi.Enable()
+
+	startRTC2()
+	mask := interrupt.Disable()
+	nrf.RTC2.EVENTS_COMPARE[1].Set(0)
+	nrf.RTC2.CC[1].Set((nrf.RTC2.COUNTER.Get() + RTCFrequency/2) & 0x00ffffff)
+	nrf.RTC2.EVTENSET.Set(nrf.RTC_EVTENSET_COMPARE1)
+	nrf.RTC2.INTENSET.Set(nrf.RTC_INTENSET_COMPARE1)
+	interrupt.Restore(mask)
+	return nil
+}
+
+// StopPPS stops the output started with Pin.PPS, and leaves the pin low. It
+// does nothing if PPS is not running.
+func StopPPS() {
+	if !pps.running {
+		return
+	}
+	nrf.RTC2.INTENCLR.Set(nrf.RTC_INTENCLR_COMPARE1)
+	nrf.RTC2.EVTENCLR.Set(nrf.RTC_EVTENCLR_COMPARE1)
+	pps.ppi.Release()
+	pin := pps.channel.Pin()
+	pps.channel.Release()
+	pin.Low()
+	pps.running = false
+}
+
+// handlePPS sets the compare register of RTC2 for the next edge of PPS.
+func handlePPS() {
+	nrf.RTC2.CC[1].Set((nrf.RTC2.CC[1].Get() + RTCFrequency/2) & 0x00ffffff)
+}
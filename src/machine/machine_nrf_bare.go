@@ -0,0 +1,12 @@
+// +build nrf,!softdevice
+
+package machine
+
+// hasSoftDevice is true when building for a target with a SoftDevice flashed,
+// which reserves some hardware resources for itself.
+const hasSoftDevice = false
+
+// interruptPriorityHigh is the priority of interrupts that must run as soon as
+// possible, such as the power-fail warning and the UART. Without a SoftDevice
+// this is the highest priority.
+const interruptPriorityHigh = 0x00
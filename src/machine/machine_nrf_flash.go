@@ -0,0 +1,157 @@
+// +build nrf
+
+package machine
+
+import (
+	"device/nrf"
+	"errors"
+	"runtime/volatile"
+	"unsafe"
+)
+
+var (
+	ErrFlashReserved  = errors.New("machine: flash address outside the free part of the application region")
+	ErrFlashAlignment = errors.New("machine: flash address or length not aligned")
+)
+
+// Symbols of the linker script. FLASH_TEXT is the flash region of the
+// application, which starts after the MBR and SoftDevice on targets that have
+// them.
+
+//go:extern _flash_start
+var flashStartSymbol [0]byte
+
+//go:extern _flash_end
+var flashEndSymbol [0]byte
+
+//go:extern _sidata
+var sidataSymbol [0]byte
+
+//go:extern _sdata
+var sdataSymbol [0]byte
+
+//go:extern _edata
+var edataSymbol [0]byte
+
+// FlashPageSize returns the size in bytes of a page of the internal flash,
+// which is the unit erased by EraseFlashPage: 1kB on the nrf51 and 4kB on the
+// nrf52 chips.
+func FlashPageSize() uintptr {
+	return uintptr(nrf.FICR.CODEPAGESIZE.Get())
+}
+
+// ApplicationFlash returns the region of the internal flash that belongs to the
+// application, from start up to (but not including) end. It starts after the
+// MBR and SoftDevice, as set in the linker script of the target, and ends at
+// the end of the flash or at the bootloader, if the UICR records one. The
+// bootloader settings and MBR parameter pages are above the bootloader, so they
+// are outside this region too.
+func ApplicationFlash() (start, end uintptr) {
+	start = uintptr(unsafe.Pointer(&flashStartSymbol))
+	end = uintptr(unsafe.Pointer(&flashEndSymbol))
+	if bootloader := uintptr(bootloaderAddress()); bootloader > start && bootloader < end {
+		end = bootloader
+	}
+	return start, end
+}
+
+// FlashDataRegion returns the part of the application region that is not used
+// by the program itself, starting at the first page after the program image.
+// This region is free for application data, and it is the only region that
+// EraseFlashPage and WriteFlash accept: writes to the program, the MBR, the
+// SoftDevice or the bootloader are refused with ErrFlashReserved. Note that
+// the region moves when the program grows, so data that must survive an update
+// is best stored at the end of the region.
+func FlashDataRegion() (start, end uintptr) {
+	appStart, end := ApplicationFlash()
+	// The program image ends with the initial values of .data.
+	imageEnd := uintptr(unsafe.Pointer(&sidataSymbol)) +
+		(uintptr(unsafe.Pointer(&edataSymbol)) - uintptr(unsafe.Pointer(&sdataSymbol)))
+	if imageEnd < appStart {
+		imageEnd = appStart
+	}
+	pageSize := FlashPageSize()
+	start = (imageEnd + pageSize - 1) &^ (pageSize - 1)
+	if start > end {
+		start = end
+	}
+	return start, end
+}
+
+// checkFlashRange returns ErrFlashReserved if the range of size bytes at addr
+// is not entirely within FlashDataRegion.
+func checkFlashRange(addr, size uintptr) error {
+	start, end := FlashDataRegion()
+	if addr < start || addr > end || size > end-addr {
+		return ErrFlashReserved
+	}
+	return nil
+}
+
+// EraseFlashPage erases the page of the internal flash that starts at addr,
+// which sets all its bytes to 0xff. The address must be aligned to
+// FlashPageSize and the page must be within FlashDataRegion.
+//
+// The CPU stalls while the page is erased, which takes up to 85ms on the nrf52
+// chips and 22ms on the nrf51, so interrupts are delayed as well. The NVMC
+// belongs to the SoftDevice while it is enabled: use its flash API instead in
+// that case.
+//
+// SPI transfers pause for the whole erase: the SPI peripheral is driven by
+// the CPU one byte at a time, so both Tx and TxWithCallback stop clocking
+// after the byte in progress, and TriggerOnTimer skips the transfers that fall
+// in the erase. Running the driver from RAM wouldn't help, as the interrupt
+// vectors are in flash and TinyGo can't place functions in RAM. No data is
+// corrupted, as SPI masters own the clock, but a device that streams data
+// (such as a sensor with a FIFO) may overflow in the meantime. Erase pages
+// ahead of time, while such a device is idle, and only write during the
+// stream: WriteFlash stalls for a single word at a time.
+func EraseFlashPage(addr uintptr) error {
+	pageSize := FlashPageSize()
+	if addr&(pageSize-1) != 0 {
+		return ErrFlashAlignment
+	}
+	if err := checkFlashRange(addr, pageSize); err != nil {
+		return err
+	}
+	nrf.NVMC.CONFIG.Set(nrf.NVMC_CONFIG_WEN_Een)
+	waitForFlash()
+	nrf.NVMC.ERASEPAGE.Set(uint32(addr))
+	waitForFlash()
+	nrf.NVMC.CONFIG.Set(nrf.NVMC_CONFIG_WEN_Ren)
+	return nil
+}
+
+// WriteFlash writes data to the internal flash at addr, which must be within
+// FlashDataRegion. The address and the length of data must be multiples of 4,
+// as the flash is written in words. Writing can only clear bits, so the area
+// must have been erased with EraseFlashPage first.
+//
+// Each word stalls the CPU for about 41µs on the nrf52 chips and 46µs on the
+// nrf51, after which pending interrupts run before the next word is written,
+// so an SPI transfer in the background is only delayed by that much per word.
+// Like EraseFlashPage, it can't be used while the SoftDevice is enabled.
+func WriteFlash(addr uintptr, data []byte) error {
+	if addr%4 != 0 || len(data)%4 != 0 {
+		return ErrFlashAlignment
+	}
+	if err := checkFlashRange(addr, uintptr(len(data))); err != nil {
+		return err
+	}
+	nrf.NVMC.CONFIG.Set(nrf.NVMC_CONFIG_WEN_Wen)
+	waitForFlash()
+	for i := 0; i < len(data); i += 4 {
+		// data doesn't need to be word aligned in RAM.
+		word := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		volatile.StoreUint32((*uint32)(unsafe.Pointer(addr+uintptr(i))), word)
+		waitForFlash()
+	}
+	nrf.NVMC.CONFIG.Set(nrf.NVMC_CONFIG_WEN_Ren)
+	return nil
+}
+
+// waitForFlash waits until the NVMC is ready for the next operation.
+func waitForFlash() {
+	for nrf.NVMC.READY.Get() == nrf.NVMC_READY_READY_Busy {
+	}
+}
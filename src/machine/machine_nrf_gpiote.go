@@ -0,0 +1,92 @@
+// +build nrf
+
+package machine
+
+import (
+	"device/nrf"
+	"runtime/interrupt"
+)
+
+// GPIOTEChannel is a GPIOTE (GPIO tasks and events) channel. Each channel can
+// generate an event when a pin changes, or change a pin when its task is
+// triggered. There are only a few of them (4 on the nrf51, 8 on the nrf52), and
+// configuring more than one channel for the same pin results in unpredictable
+// behavior.
+//
+// Channels must be allocated with AllocateGPIOTEChannel, so that different
+// drivers (and Pin.SetInterrupt) don't use the same channel.
+type GPIOTEChannel uint8
+
+// Bitmap of GPIOTE channels that have been allocated.
+var gpioteChannelsUsed uint32
+
+// AllocateGPIOTEChannel returns a free GPIOTE channel, or
+// ErrNoPinChangeChannel if all channels are in use. The channel is not yet
+// configured.
+func AllocateGPIOTEChannel() (GPIOTEChannel, error) {
+	mask := interrupt.Disable()
+	defer interrupt.Restore(mask)
+
+	for i := range nrf.GPIOTE.CONFIG {
+		if gpioteChannelsUsed&(1<<uint(i)) == 0 {
+			gpioteChannelsUsed |= 1 << uint(i)
+			return GPIOTEChannel(i), nil
+		}
+	}
+	return 0, ErrNoPinChangeChannel
+}
+
+// AvailableGPIOTEChannels returns the number of GPIOTE channels that are
+// currently free, so that a driver can check whether it can allocate the
+// channels it needs before it starts. Pin change interrupts set with
+// SetInterrupt use a channel per pin.
+func AvailableGPIOTEChannels() int {
+	n := 0
+	for i := range nrf.GPIOTE.CONFIG {
+		if gpioteChannelsUsed&(1<<uint(i)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Release disables this channel and returns it to the pool of free channels.
+func (ch GPIOTEChannel) Release() {
+	nrf.GPIOTE.INTENCLR.Set(1 << uint(ch))
+	nrf.GPIOTE.CONFIG[ch].Set(0)
+	nrf.GPIOTE.EVENTS_IN[ch].Set(0)
+	mask := interrupt.Disable()
+	gpioteChannelsUsed &^= 1 << uint(ch)
+	interrupt.Restore(mask)
+}
+
+// ConfigureEvent configures this channel to generate an event on the given
+// change of the pin.
+func (ch GPIOTEChannel) ConfigureEvent(p Pin, change PinChange) {
+	nrf.GPIOTE.CONFIG[ch].Set(nrf.GPIOTE_CONFIG_MODE_Event<<nrf.GPIOTE_CONFIG_MODE_Pos |
+		uint32(p)<<nrf.GPIOTE_CONFIG_PSEL_Pos |
+		uint32(change)<<nrf.GPIOTE_CONFIG_POLARITY_Pos)
+}
+
+// ConfigureTask configures this channel to toggle the pin every time its OUT
+// task is triggered, for example through PPI. The pin starts at the given
+// level. While the channel is configured, the pin is driven by the GPIOTE and
+// the OUT register of the GPIO port has no effect on it.
+func (ch GPIOTEChannel) ConfigureTask(p Pin, initial bool) {
+	outinit := uint32(nrf.GPIOTE_CONFIG_OUTINIT_Low)
+	if initial {
+		outinit = nrf.GPIOTE_CONFIG_OUTINIT_High
+	}
+	nrf.GPIOTE.CONFIG[ch].Set(nrf.GPIOTE_CONFIG_MODE_Task<<nrf.GPIOTE_CONFIG_MODE_Pos |
+		uint32(p)<<nrf.GPIOTE_CONFIG_PSEL_Pos |
+		nrf.GPIOTE_CONFIG_POLARITY_Toggle<<nrf.GPIOTE_CONFIG_POLARITY_Pos |
+		outinit<<nrf.GPIOTE_CONFIG_OUTINIT_Pos)
+}
+
+// Pin returns the pin this channel is configured for.
+func (ch GPIOTEChannel) Pin() Pin {
+	// On the nrf52833 and nrf52840, the PORT field follows PSEL directly, so
+	// together they hold the pin number as written by ConfigureEvent and
+	// ConfigureTask. The bit after PSEL reads as zero on the other chips.
+	return Pin((nrf.GPIOTE.CONFIG[ch].Get() >> nrf.GPIOTE_CONFIG_PSEL_Pos) & 0x3f)
+}
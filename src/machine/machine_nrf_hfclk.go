@@ -0,0 +1,61 @@
+// +build nrf
+
+package machine
+
+import (
+	"device/nrf"
+	"runtime/interrupt"
+)
+
+// Number of outstanding RequestHFXO calls.
+var hfxoRequests uint8
+
+// RequestHFXO starts the external high frequency crystal oscillator (HFXO) if
+// it isn't running yet, and waits until it is stable. Every call must be
+// matched with a call to ReleaseHFXO when the crystal isn't needed anymore.
+//
+// After reset the HFCLK runs from the internal RC oscillator, which is enough
+// for the CPU and most peripherals (SPI, I2C, UART, ADC, timers), and HFXO is
+// only started when needed: it draws a significant current. The radio and USB
+// require it, so Radio.Configure and the USB driver request it themselves. It
+// is also worth requesting for a UART at high baud rates, as the RC
+// oscillator is only accurate to a few percent, or for precise timing with a
+// TIMER. The LFCLK synthesized from the HFCLK (see LFCLKSourceSynth) keeps it
+// running all the time.
+//
+// The CLOCK peripheral belongs to the SoftDevice while it is enabled, so use
+// the SoftDevice API instead in that case.
+func RequestHFXO() {
+	mask := interrupt.Disable()
+	hfxoRequests++
+	first := hfxoRequests == 1
+	interrupt.Restore(mask)
+	if !first {
+		// Another driver started it already. Wait until it is stable, in
+		// case that driver is still waiting for it too.
+		for nrf.CLOCK.HFCLKSTAT.Get()&nrf.CLOCK_HFCLKSTAT_SRC_Msk == 0 {
+		}
+		return
+	}
+
+	nrf.CLOCK.EVENTS_HFCLKSTARTED.Set(0)
+	nrf.CLOCK.TASKS_HFCLKSTART.Set(1)
+	for nrf.CLOCK.EVENTS_HFCLKSTARTED.Get() == 0 {
+	}
+	nrf.CLOCK.EVENTS_HFCLKSTARTED.Set(0)
+}
+
+// ReleaseHFXO undoes a call to RequestHFXO. Once all requests are released,
+// the HFCLK switches back to the internal RC oscillator, unless the LFCLK is
+// synthesized from it.
+func ReleaseHFXO() {
+	mask := interrupt.Disable()
+	defer interrupt.Restore(mask)
+	if hfxoRequests == 0 {
+		return
+	}
+	hfxoRequests--
+	if hfxoRequests == 0 && LowFrequencyClockSource() != LFCLKSourceSynth {
+		nrf.CLOCK.TASKS_HFCLKSTOP.Set(1)
+	}
+}
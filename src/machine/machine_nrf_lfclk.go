@@ -0,0 +1,42 @@
+// +build nrf
+
+package machine
+
+// LFCLKSource is the source of the 32.768kHz low frequency clock (LFCLK),
+// which drives the RTC used for timekeeping by the runtime.
+//
+// The accuracy of the sources differs a lot:
+//
+//   - LFCLKSourceXtal uses an external 32.768kHz crystal. It is the most
+//     accurate (typically ±20ppm, or a few seconds per day) and uses very
+//     little power, but the board must have the crystal fitted.
+//   - LFCLKSourceRC uses the internal RC oscillator. It needs no external
+//     parts and uses little power, but it is not calibrated, so time may drift
+//     by up to a few percent (minutes per day).
+//   - LFCLKSourceSynth derives the LFCLK from the 16MHz/64MHz HFCLK. It is as
+//     accurate as the HFCLK crystal, but keeps the HFCLK running all the time,
+//     which costs much more power.
+type LFCLKSource uint8
+
+const (
+	LFCLKSourceRC    LFCLKSource = 0 // CLOCK_LFCLKSRC_SRC_RC
+	LFCLKSourceXtal  LFCLKSource = 1 // CLOCK_LFCLKSRC_SRC_Xtal
+	LFCLKSourceSynth LFCLKSource = 2 // CLOCK_LFCLKSRC_SRC_Synth
+)
+
+// LowFrequencyClockSource returns the LFCLK source the runtime starts at boot.
+// By default this is the crystal for boards that have one (see
+// HasLowFrequencyCrystal) and the internal RC oscillator otherwise. This can
+// be overridden at build time with the nrf_lfclk_rc or nrf_lfclk_synth build
+// tags, for example for a custom board without the crystal:
+//
+//	tinygo build -target=pca10040 -tags=nrf_lfclk_rc
+func LowFrequencyClockSource() LFCLKSource {
+	if lfclkSourceOverride {
+		return lfclkSource
+	}
+	if HasLowFrequencyCrystal {
+		return LFCLKSourceXtal
+	}
+	return LFCLKSourceRC
+}
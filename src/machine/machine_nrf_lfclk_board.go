@@ -0,0 +1,9 @@
+// +build nrf,!nrf_lfclk_rc,!nrf_lfclk_synth
+
+package machine
+
+// The LFCLK source follows HasLowFrequencyCrystal of the board.
+const (
+	lfclkSourceOverride = false
+	lfclkSource         = LFCLKSourceRC
+)
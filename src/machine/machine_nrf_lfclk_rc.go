@@ -0,0 +1,9 @@
+// +build nrf,nrf_lfclk_rc
+
+package machine
+
+// The LFCLK source is forced to the internal RC oscillator.
+const (
+	lfclkSourceOverride = true
+	lfclkSource         = LFCLKSourceRC
+)
@@ -0,0 +1,9 @@
+// +build nrf,nrf_lfclk_synth,!nrf_lfclk_rc
+
+package machine
+
+// The LFCLK source is forced to be synthesized from the HFCLK.
+const (
+	lfclkSourceOverride = true
+	lfclkSource         = LFCLKSourceSynth
+)
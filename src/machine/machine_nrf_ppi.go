@@ -0,0 +1,96 @@
+// +build nrf
+
+package machine
+
+import (
+	"device/nrf"
+	"errors"
+	"runtime/interrupt"
+	"runtime/volatile"
+	"unsafe"
+)
+
+var (
+	ErrNoPPIChannel = errors.New("machine: no PPI channel available")
+)
+
+// PPIChannel is a programmable PPI (Programmable Peripheral Interconnect)
+// channel. A PPI channel triggers a task of a peripheral when an event of
+// another (or the same) peripheral fires, entirely in hardware.
+//
+// Channels must be allocated with AllocatePPIChannel, so that different drivers
+// don't use the same channel.
+type PPIChannel uint8
+
+// Bitmap of PPI channels that have been allocated.
+var ppiChannelsUsed uint32
+
+// ppiChannelCount returns the number of PPI channels that can be allocated. The
+// SoftDevice reserves the highest channels for itself.
+func ppiChannelCount() int {
+	if hasSoftDevice {
+		return ppiSoftDeviceFirstChannel
+	}
+	return len(nrf.PPI.CH)
+}
+
+// AllocatePPIChannel returns a free PPI channel, or ErrNoPPIChannel if all
+// channels are in use. The channel is disabled and not yet connected.
+//
+// Note that when the SoftDevice is enabled, the PPI registers may only be
+// accessed through the SoftDevice API.
+func AllocatePPIChannel() (PPIChannel, error) {
+	mask := interrupt.Disable()
+	defer interrupt.Restore(mask)
+
+	for i := 0; i < ppiChannelCount(); i++ {
+		if ppiChannelsUsed&(1<<uint(i)) == 0 {
+			ppiChannelsUsed |= 1 << uint(i)
+			ch := PPIChannel(i)
+			ch.Disable()
+			return ch, nil
+		}
+	}
+	return 0, ErrNoPPIChannel
+}
+
+// AvailablePPIChannels returns the number of PPI channels that are currently
+// free, so that a driver can check whether it can allocate the channels it
+// needs before it starts. The channels reserved by the SoftDevice are not
+// counted.
+func AvailablePPIChannels() int {
+	n := 0
+	for i := 0; i < ppiChannelCount(); i++ {
+		if ppiChannelsUsed&(1<<uint(i)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Release disables this channel and returns it to the pool of free channels.
+func (ch PPIChannel) Release() {
+	ch.Disable()
+	mask := interrupt.Disable()
+	ppiChannelsUsed &^= 1 << uint(ch)
+	interrupt.Restore(mask)
+}
+
+// Connect sets the event that triggers this channel and the task that is
+// triggered by it. Both are peripheral registers, for example:
+//
+//     ch.Connect(&nrf.TIMER1.EVENTS_COMPARE[0], &nrf.SAADC.TASKS_SAMPLE)
+func (ch PPIChannel) Connect(event, task *volatile.Register32) {
+	nrf.PPI.CH[ch].EEP.Set(uint32(uintptr(unsafe.Pointer(event))))
+	nrf.PPI.CH[ch].TEP.Set(uint32(uintptr(unsafe.Pointer(task))))
+}
+
+// Enable enables this channel, so that the task is triggered on every event.
+func (ch PPIChannel) Enable() {
+	nrf.PPI.CHENSET.Set(1 << uint(ch))
+}
+
+// Disable disables this channel.
+func (ch PPIChannel) Disable() {
+	nrf.PPI.CHENCLR.Set(1 << uint(ch))
+}
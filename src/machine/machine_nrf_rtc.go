@@ -0,0 +1,41 @@
+// +build nrf
+
+package machine
+
+import (
+	_ "unsafe" // for go:linkname
+)
+
+// RTCFrequency is the frequency of the RTC tick counter, in Hz.
+const RTCFrequency = 32768
+
+// Ticks returns the number of RTC ticks since boot. The RTC runs from the
+// 32.768kHz low frequency clock and keeps counting while the CPU is sleeping,
+// so it is a reliable time source in low power applications. This is the same
+// source the runtime uses for time.Now and time.Sleep.
+//
+// The hardware counter is only 24 bits wide and is extended in software, so
+// the time must be read (by calling Ticks or any time function) at least once
+// every 8 minutes to avoid losing counter overflows.
+func Ticks() uint64 {
+	return uint64(runtimeTicks())
+}
+
+// TicksToNanoseconds converts RTC ticks (at 32768Hz) to nanoseconds.
+func TicksToNanoseconds(ticks uint64) int64 {
+	// The following calculation is actually the following, but with both sides
+	// reduced to reduce the risk of overflow:
+	//     ticks * 1e9 / 32768
+	return int64(ticks) * 1953125 / 64
+}
+
+// NanosecondsToTicks converts nanoseconds to RTC ticks (running at 32768Hz).
+func NanosecondsToTicks(ns int64) uint64 {
+	// The following calculation is actually the following, but with both sides
+	// reduced to reduce the risk of overflow:
+	//     ns * 32768 / 1e9
+	return uint64(ns * 64 / 1953125)
+}
+
+//go:linkname runtimeTicks runtime.ticks
+func runtimeTicks() int64
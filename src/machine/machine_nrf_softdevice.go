@@ -0,0 +1,14 @@
+// +build nrf,softdevice
+
+package machine
+
+// hasSoftDevice is true when building for a target with a SoftDevice flashed,
+// which reserves some hardware resources for itself.
+const hasSoftDevice = true
+
+// interruptPriorityHigh is the priority of interrupts that must run as soon as
+// possible, such as the power-fail warning and the UART. The SoftDevice
+// reserves the highest priorities (0 and 1 on the nrf52, 0 on the nrf51) and
+// priority 4 or 2 for its API calls, so this is the highest one left to the
+// application: priority 2 on the nrf52 and 1 on the nrf51.
+const interruptPriorityHigh = 0x40
@@ -0,0 +1,66 @@
+// +build nrf
+
+package machine
+
+import (
+	"device/nrf"
+	"runtime/interrupt"
+)
+
+// ReadTemperature reads the die temperature of the chip, in milli-degrees
+// Celsius, with a resolution of 0.25°C. This blocks for the duration of a
+// measurement (about 36µs on the nrf52).
+//
+// Note that when the SoftDevice is enabled, the TEMP peripheral may only be
+// accessed through the SoftDevice API.
+func ReadTemperature() int32 {
+	nrf.TEMP.EVENTS_DATARDY.Set(0)
+	nrf.TEMP.TASKS_START.Set(1)
+	for nrf.TEMP.EVENTS_DATARDY.Get() == 0 {
+	}
+	nrf.TEMP.EVENTS_DATARDY.Set(0)
+	return tempValue()
+}
+
+// The callback of a measurement started with ReadTemperatureAsync.
+var tempCallback func(int32)
+
+// ReadTemperatureAsync starts a temperature measurement and returns right away.
+// When the measurement is done, callback is called from the TEMP interrupt with
+// the temperature in milli-degrees Celsius, as returned by ReadTemperature.
+// This allows the CPU to sleep during the measurement. Only one measurement
+// can be in progress at a time: it returns ErrBusInUse otherwise.
+func ReadTemperatureAsync(callback func(int32)) error {
+	mask := interrupt.Disable()
+	if tempCallback != nil {
+		interrupt.Restore(mask)
+		return ErrBusInUse
+	}
+	tempCallback = callback
+	interrupt.Restore(mask)
+
+	nrf.TEMP.EVENTS_DATARDY.Set(0)
+	nrf.TEMP.INTENSET.Set(nrf.TEMP_INTENSET_DATARDY_Msk)
+	intr := interrupt.New(nrf.IRQ_TEMP, func(interrupt.Interrupt) {
+		nrf.TEMP.EVENTS_DATARDY.Set(0)
+		nrf.TEMP.INTENCLR.Set(nrf.TEMP_INTENCLR_DATARDY_Msk)
+		callback := tempCallback
+		tempCallback = nil
+		if callback != nil {
+			callback(tempValue())
+		}
+	})
+	intr.SetPriority(interruptPriorityLow)
+	intr.Enable()
+	nrf.TEMP.TASKS_START.Set(1)
+	return nil
+}
+
+// tempValue returns the result of the last measurement in milli-degrees
+// Celsius and stops the TEMP peripheral.
+func tempValue() int32 {
+	// The result is in units of 0.25°C.
+	temp := int32(nrf.TEMP.TEMP.Get()) * 250
+	nrf.TEMP.TASKS_STOP.Set(1)
+	return temp
+}
@@ -0,0 +1,72 @@
+// +build nrf
+
+package machine
+
+import (
+	"device/nrf"
+	"runtime/interrupt"
+)
+
+// TimerCapture is a capture register of a TIMER, for CaptureTimers. The
+// register must not be in use by the driver that owns the timer: for example,
+// the background ADC scan only uses CC[0] of TIMER2.
+type TimerCapture struct {
+	Timer   *nrf.TIMER_Type
+	Channel uint8
+}
+
+// CaptureTimers captures the counters of up to 8 running timers at the same
+// instant, and returns the RTC tick count (as returned by Ticks) of that
+// instant. The counter of caps[i] is stored in values[i]. This puts timestamps
+// taken with different timers, such as the sample times of an ADC scan and
+// the edges of a data ready pin captured with CaptureEdges, on a common
+// timeline: subtract the captured counter value from a timestamp of the same
+// timer to get its offset from the returned tick.
+//
+// The capture is done in hardware: the next tick event of the RTC triggers the
+// capture task of every timer through PPI, so all values are captured in the
+// same clock cycle, and the tick count is exact. It waits for that tick, for
+// up to 31µs, with interrupts disabled. One PPI channel is needed for every
+// timer, and they are released before it returns. As timers drift against
+// the RTC (they run from a different clock), capture again regularly when the
+// timelines must stay aligned for a long time.
+func CaptureTimers(caps []TimerCapture, values []uint32) (ticks uint64, err error) {
+	if len(caps) == 0 || len(caps) > 8 || len(values) < len(caps) {
+		return 0, ErrInvalidConfig
+	}
+	var channels [8]PPIChannel
+	var chmask uint32
+	for i, c := range caps {
+		ch, err := AllocatePPIChannel()
+		if err != nil {
+			for _, ch := range channels[:i] {
+				ch.Release()
+			}
+			return 0, err
+		}
+		channels[i] = ch
+		chmask |= 1 << uint(ch)
+		ch.Connect(&nrf.RTC1.EVENTS_TICK, &c.Timer.TASKS_CAPTURE[c.Channel])
+	}
+
+	mask := interrupt.Disable()
+	// The RTC only generates the tick event while it is enabled, which it
+	// isn't normally: the runtime uses the compare event instead. Enable all
+	// PPI channels at once so that every timer is captured at the same tick.
+	nrf.RTC1.EVTENSET.Set(nrf.RTC_EVTENSET_TICK_Msk)
+	nrf.PPI.CHENSET.Set(chmask)
+	nrf.RTC1.EVENTS_TICK.Set(0)
+	for nrf.RTC1.EVENTS_TICK.Get() == 0 {
+	}
+	nrf.PPI.CHENCLR.Set(chmask)
+	ticks = Ticks()
+	nrf.RTC1.EVTENCLR.Set(nrf.RTC_EVTENCLR_TICK_Msk)
+	nrf.RTC1.EVENTS_TICK.Set(0)
+	interrupt.Restore(mask)
+
+	for i, c := range caps {
+		values[i] = c.Timer.CC[c.Channel].Get()
+		channels[i].Release()
+	}
+	return ticks, nil
+}
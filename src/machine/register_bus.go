@@ -0,0 +1,41 @@
+package machine
+
+// RegisterBus is the common shape of a device that is organized in terms of
+// registers, whether it is connected over SPI or I2C. Many sensor chips
+// support both, so a driver that accepts a RegisterBus works with either
+// wiring option. SPIDevice and I2CDevice implement it, on the targets that
+// provide them.
+type RegisterBus interface {
+	// ReadRegister reads len(data) bytes starting at the given register.
+	ReadRegister(register uint8, data []byte) error
+
+	// WriteRegister writes data starting at the given register.
+	WriteRegister(register uint8, data []byte) error
+}
+
+// RegVal is a register and the value to write to it, as an entry of the
+// register table passed to WriteRegisterList.
+type RegVal struct {
+	Reg   uint8
+	Value uint8
+}
+
+// WriteRegisterList writes every value of list to its register, in order, as
+// most sensors need at startup:
+//
+//	err := machine.WriteRegisterList(dev, []machine.RegVal{
+//		{0x10, 0x60}, // CTRL1: 416Hz, 2g
+//		{0x11, 0x60}, // CTRL2: 416Hz, 250dps
+//	})
+//
+// Every register is written with a separate WriteRegister call, so on SPI each
+// write gets its own chip select frame. It stops at the first write that
+// fails and returns its error, leaving the remaining registers unwritten.
+func WriteRegisterList(bus RegisterBus, list []RegVal) error {
+	for _, rv := range list {
+		if err := bus.WriteRegister(rv.Reg, []byte{rv.Value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
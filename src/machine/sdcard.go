@@ -0,0 +1,317 @@
+// +build nrf
+
+package machine
+
+import "errors"
+
+var (
+	ErrSDNoCard   = errors.New("machine: no SD card or card not supported")
+	ErrSDCommand  = errors.New("machine: SD card command failed")
+	ErrSDRejected = errors.New("machine: SD card rejected the data")
+)
+
+// SDBlockSize is the size in bytes of a block of an SD card, as read and
+// written by SDCard.ReadBlock and SDCard.WriteBlock.
+const SDBlockSize = 512
+
+// SD card commands used in SPI mode.
+const (
+	sdCmdGoIdleState     = 0  // CMD0: reset and enter SPI mode
+	sdCmdSendIfCond      = 8  // CMD8: check the supply voltage, SD v2 only
+	sdCmdSetBlockLen     = 16 // CMD16: set the block size of standard capacity cards
+	sdCmdReadSingleBlock = 17 // CMD17
+	sdCmdWriteBlock      = 24 // CMD24
+	sdCmdAppCmd          = 55 // CMD55: the next command is an application command
+	sdCmdReadOCR         = 58 // CMD58: read the operating conditions register
+	sdAcmdSendOpCond     = 41 // ACMD41: start the initialization
+)
+
+// R1 response bits and data tokens.
+const (
+	sdR1Idle         = 0x01
+	sdR1IllegalCmd   = 0x04
+	sdDataStartToken = 0xfe
+	sdDataAccepted   = 0x05
+)
+
+// SDCard is an SD or SDHC/SDXC card connected to an SPI bus, accessed in SPI
+// mode as a block device of 512-byte blocks. This is the minimum needed to
+// mount a filesystem on top of it:
+//
+//	sd := machine.SDCard{Device: machine.SPIDevice{Bus: machine.SPI0, CS: csPin}}
+//	sd.Device.Configure()
+//	err := sd.Init()
+//	...
+//	err = sd.ReadBlock(0, buf[:])
+//
+// The bus must be configured in mode 0 beforehand, at the frequency to use
+// after initialization (up to 8MHz works with all cards). MMC cards and SD
+// cards older than version 1 are not supported.
+type SDCard struct {
+	Device SPIDevice
+
+	highCapacity bool // addressed in blocks instead of bytes
+}
+
+// Init resets the card into SPI mode and initializes it. It must be called
+// before any other method, and again when a card has been inserted. The
+// initialization is done at 250kHz as the specification requires a clock of at
+// most 400kHz until the card is ready, after which the bus frequency that was
+// configured before is restored.
+func (sd *SDCard) Init() error {
+	device := sd.Device
+	freq := device.Bus.Frequency()
+	// Limit the device rather than only the bus: a device with its own
+	// Frequency switches the bus to it before every command.
+	sd.Device.MaxFrequency = 250000
+	// The power up clocks are sent without selecting the card.
+	sd.Device.Bus.applyFrequency(250000)
+	err := sd.init()
+	sd.Device = device
+	sd.Device.Bus.applyFrequency(freq)
+	return err
+}
+
+func (sd *SDCard) init() error {
+	// Send at least 74 clocks with the card deselected, so that it can power
+	// up.
+	sd.Device.CS.High()
+	for i := 0; i < 10; i++ {
+		if _, err := sd.Device.Bus.Transfer(0xff); err != nil {
+			return err
+		}
+	}
+
+	// Reset the card. It enters SPI mode because the chip select is
+	// asserted.
+	var r1 byte
+	for i := 0; ; i++ {
+		var err error
+		r1, err = sd.command(sdCmdGoIdleState, 0, 0x95)
+		sd.Device.deselectDevice()
+		if err != nil {
+			return err
+		}
+		if r1 == sdR1Idle {
+			break
+		}
+		if i == 10 {
+			return ErrSDNoCard
+		}
+	}
+
+	// Only version 2 cards (including all SDHC and SDXC cards) understand
+	// CMD8, which must be sent with the right CRC.
+	v2 := false
+	r1, err := sd.command(sdCmdSendIfCond, 0x1aa, 0x87)
+	if err == nil && r1&sdR1IllegalCmd == 0 {
+		var r7 [4]byte
+		err = sd.read(r7[:])
+		if err == nil && r7[3] != 0xaa {
+			err = ErrSDNoCard
+		}
+		v2 = true
+	}
+	sd.Device.deselectDevice()
+	if err != nil {
+		return err
+	}
+
+	// Start the initialization and wait until the card is ready, which takes
+	// up to a second. Version 2 cards are told that the host supports high
+	// capacity cards.
+	arg := uint32(0)
+	if v2 {
+		arg = 0x40000000
+	}
+	for i := 0; ; i++ {
+		r1, err = sd.appCommand(sdAcmdSendOpCond, arg)
+		sd.Device.deselectDevice()
+		if err != nil {
+			return err
+		}
+		if r1 == 0 {
+			break
+		}
+		if r1 != sdR1Idle {
+			return ErrSDNoCard
+		}
+		if i == 1000 {
+			return ErrTimeout
+		}
+		delayNanoseconds(1000000)
+	}
+
+	// Find out whether the card is addressed in blocks or bytes.
+	sd.highCapacity = false
+	if v2 {
+		r1, err = sd.command(sdCmdReadOCR, 0, 0xff)
+		var ocr [4]byte
+		if err == nil && r1 == 0 {
+			err = sd.read(ocr[:])
+		} else if err == nil {
+			err = ErrSDCommand
+		}
+		sd.Device.deselectDevice()
+		if err != nil {
+			return err
+		}
+		sd.highCapacity = ocr[0]&0x40 != 0 // CCS bit
+	}
+	if !sd.highCapacity {
+		r1, err = sd.command(sdCmdSetBlockLen, SDBlockSize, 0xff)
+		sd.Device.deselectDevice()
+		if err != nil {
+			return err
+		}
+		if r1 != 0 {
+			return ErrSDCommand
+		}
+	}
+	return nil
+}
+
+// ReadBlock reads the block with the given block number into buf, which must
+// be SDBlockSize bytes long.
+func (sd *SDCard) ReadBlock(block uint32, buf []byte) error {
+	if len(buf) != SDBlockSize {
+		return ErrInvalidConfig
+	}
+	err := sd.readBlock(block, buf)
+	sd.Device.deselectDevice()
+	return err
+}
+
+func (sd *SDCard) readBlock(block uint32, buf []byte) error {
+	r1, err := sd.command(sdCmdReadSingleBlock, sd.address(block), 0xff)
+	if err != nil {
+		return err
+	}
+	if r1 != 0 {
+		return ErrSDCommand
+	}
+	if err := sd.waitFor(sdDataStartToken); err != nil {
+		return err
+	}
+	if err := sd.read(buf); err != nil {
+		return err
+	}
+	var crc [2]byte // not checked
+	return sd.read(crc[:])
+}
+
+// WriteBlock writes buf, which must be SDBlockSize bytes long, to the block
+// with the given block number. It returns once the card has finished
+// programming the block.
+func (sd *SDCard) WriteBlock(block uint32, buf []byte) error {
+	if len(buf) != SDBlockSize {
+		return ErrInvalidConfig
+	}
+	err := sd.writeBlock(block, buf)
+	sd.Device.deselectDevice()
+	return err
+}
+
+func (sd *SDCard) writeBlock(block uint32, buf []byte) error {
+	r1, err := sd.command(sdCmdWriteBlock, sd.address(block), 0xff)
+	if err != nil {
+		return err
+	}
+	if r1 != 0 {
+		return ErrSDCommand
+	}
+	bus := sd.Device.Bus
+	if err := bus.Tx([]byte{0xff, sdDataStartToken}, nil); err != nil {
+		return err
+	}
+	if err := bus.Tx(buf, nil); err != nil {
+		return err
+	}
+	// Send a dummy CRC (CRCs are disabled in SPI mode) and read the data
+	// response.
+	var resp [3]byte
+	if err := bus.Tx([]byte{0xff, 0xff, 0xff}, resp[:]); err != nil {
+		return err
+	}
+	if resp[2]&0x1f != sdDataAccepted {
+		return ErrSDRejected
+	}
+	return sd.waitFor(0xff) // the card holds SDO low while it is busy
+}
+
+// address returns the address that identifies the given block in commands.
+func (sd *SDCard) address(block uint32) uint32 {
+	if sd.highCapacity {
+		return block
+	}
+	return block * SDBlockSize
+}
+
+// command selects the card and sends a command, and returns its R1 response.
+// The card stays selected, so the caller can read the rest of the response,
+// and must deselect it afterwards.
+func (sd *SDCard) command(cmd byte, arg uint32, crc byte) (byte, error) {
+	sd.Device.selectDevice()
+	// Wait until the card is not busy anymore, except for CMD0 which may be
+	// sent while the card is in any state.
+	if cmd != sdCmdGoIdleState {
+		if err := sd.waitFor(0xff); err != nil {
+			return 0, err
+		}
+	}
+	frame := [6]byte{0x40 | cmd, byte(arg >> 24), byte(arg >> 16), byte(arg >> 8), byte(arg), crc}
+	if err := sd.Device.Bus.Tx(frame[:], nil); err != nil {
+		return 0, err
+	}
+	// The response arrives within 8 bytes and has the top bit cleared.
+	for i := 0; i < 8; i++ {
+		r1, err := sd.Device.Bus.Transfer(0xff)
+		if err != nil {
+			return 0, err
+		}
+		if r1&0x80 == 0 {
+			return r1, nil
+		}
+	}
+	return 0, ErrTimeout
+}
+
+// appCommand sends an application specific command (ACMD), which is CMD55
+// followed by the command.
+func (sd *SDCard) appCommand(cmd byte, arg uint32) (byte, error) {
+	_, err := sd.command(sdCmdAppCmd, 0, 0xff)
+	sd.Device.deselectDevice()
+	if err != nil {
+		return 0, err
+	}
+	return sd.command(cmd, arg, 0xff)
+}
+
+// read reads len(buf) bytes into buf while sending 0xff, which the card
+// expects on its data input while it is sending.
+func (sd *SDCard) read(buf []byte) error {
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	// Tx reads each byte of the write buffer before the byte at the same
+	// index is received, so the same buffer can be used for both.
+	return sd.Device.Bus.Tx(buf, buf)
+}
+
+// waitFor reads bytes until the card sends the given byte, for up to about
+// half a second.
+func (sd *SDCard) waitFor(b byte) error {
+	for i := 0; i < 50000; i++ {
+		r, err := sd.Device.Bus.Transfer(0xff)
+		if err != nil {
+			return err
+		}
+		if r == b {
+			return nil
+		}
+		if i >= 100 {
+			delayNanoseconds(10000)
+		}
+	}
+	return ErrTimeout
+}
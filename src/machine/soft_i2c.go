@@ -0,0 +1,205 @@
+// +build nrf
+
+package machine
+
+// SoftI2C is an I2C controller bit-banged on any two GPIO pins, for boards
+// where the pins of the TWI peripherals are unavailable or all TWI instances
+// are in use. It has the same methods as I2C, so drivers that take an
+// interface with the Tx method (or the register methods) work with either.
+//
+// The slave may stretch the clock by holding SCL low: SoftI2C waits for SCL to
+// be released for up to 25ms before returning an error, so slow sensors that
+// need time to prepare a response work too.
+type SoftI2C struct {
+	scl, sda   Pin
+	halfPeriod uint32 // half the SCL period in nanoseconds
+}
+
+// softI2CStretchTimeout is the longest time in microseconds SoftI2C waits for
+// a slave that is stretching the clock. This is the SMBus timeout.
+const softI2CStretchTimeout = 25000
+
+// Configure sets up the pins of the bus. The pins default to SCL_PIN and
+// SDA_PIN, and the frequency to 100kHz. The bus timing is generated with
+// busy-wait delays, which have a granularity of 1µs on the nrf52, so the
+// actual frequency is somewhat lower than configured: 400kHz results in about
+// 250kHz.
+func (i2c *SoftI2C) Configure(config I2CConfig) {
+	if config.Frequency == 0 {
+		config.Frequency = TWI_FREQ_100KHZ
+	}
+	if config.SDA == 0 && config.SCL == 0 {
+		config.SDA = SDA_PIN
+		config.SCL = SCL_PIN
+	}
+	i2c.scl = config.SCL
+	i2c.sda = config.SDA
+	i2c.halfPeriod = 500000000 / config.Frequency
+	i2c.scl.configureOpenDrain()
+	i2c.sda.configureOpenDrain()
+}
+
+// Tx does a single I2C transaction at the specified address. It clocks out
+// the given address, writes the bytes in w, reads back len(r) bytes and stores
+// them in r, and generates a stop condition on the bus. See I2C.Tx.
+func (i2c *SoftI2C) Tx(addr uint16, w, r []byte) error {
+	err := i2c.tx(uint8(addr), w, r)
+	i2c.stop()
+	return err
+}
+
+func (i2c *SoftI2C) tx(addr uint8, w, r []byte) error {
+	if len(w) != 0 || len(r) == 0 {
+		if err := i2c.start(); err != nil {
+			return err
+		}
+		if err := i2c.writeByte(addr << 1); err != nil {
+			return err
+		}
+		for _, b := range w {
+			if err := i2c.writeByte(b); err != nil {
+				return err
+			}
+		}
+	}
+	if len(r) != 0 {
+		// This is a repeated start if something was written first.
+		if err := i2c.start(); err != nil {
+			return err
+		}
+		if err := i2c.writeByte(addr<<1 | 1); err != nil {
+			return err
+		}
+		for i := range r {
+			b, err := i2c.readByte(i+1 < len(r))
+			if err != nil {
+				return err
+			}
+			r[i] = b
+		}
+	}
+	return nil
+}
+
+// WriteRegister transmits first the register and then the data to the
+// peripheral device. See I2C.WriteRegister.
+func (i2c *SoftI2C) WriteRegister(address uint8, register uint8, data []byte) error {
+	buf := make([]uint8, len(data)+1)
+	buf[0] = register
+	copy(buf[1:], data)
+	return i2c.Tx(uint16(address), buf, nil)
+}
+
+// ReadRegister transmits the register, restarts the connection as a read
+// operation, and reads the response. See I2C.ReadRegister.
+func (i2c *SoftI2C) ReadRegister(address uint8, register uint8, data []byte) error {
+	return i2c.Tx(uint16(address), []byte{register}, data)
+}
+
+// delay waits for half a clock period.
+func (i2c *SoftI2C) delay() {
+	delayNanoseconds(i2c.halfPeriod)
+}
+
+// releaseSCL releases SCL and waits until it is high, which may take a while
+// if the slave stretches the clock.
+func (i2c *SoftI2C) releaseSCL() error {
+	i2c.scl.High()
+	for i := 0; !i2c.scl.Get(); i++ {
+		if i == softI2CStretchTimeout {
+			return ErrTimeout
+		}
+		delayNanoseconds(1000)
+	}
+	return nil
+}
+
+// start generates a start condition, or a repeated start condition in the
+// middle of a transaction: SDA goes low while SCL is high.
+func (i2c *SoftI2C) start() error {
+	i2c.sda.High()
+	i2c.delay()
+	if err := i2c.releaseSCL(); err != nil {
+		return err
+	}
+	i2c.delay()
+	i2c.sda.Low()
+	i2c.delay()
+	i2c.scl.Low()
+	return nil
+}
+
+// stop generates a stop condition: SDA goes high while SCL is high.
+func (i2c *SoftI2C) stop() {
+	i2c.sda.Low()
+	i2c.delay()
+	i2c.releaseSCL()
+	i2c.delay()
+	i2c.sda.High()
+	i2c.delay()
+}
+
+// writeBit clocks out a single bit.
+func (i2c *SoftI2C) writeBit(bit bool) error {
+	i2c.sda.Set(bit)
+	i2c.delay()
+	if err := i2c.releaseSCL(); err != nil {
+		return err
+	}
+	i2c.delay()
+	i2c.scl.Low()
+	return nil
+}
+
+// readBit releases SDA and clocks in a single bit.
+func (i2c *SoftI2C) readBit() (bool, error) {
+	i2c.sda.High()
+	i2c.delay()
+	if err := i2c.releaseSCL(); err != nil {
+		return false, err
+	}
+	bit := i2c.sda.Get()
+	i2c.delay()
+	i2c.scl.Low()
+	return bit, nil
+}
+
+// writeByte clocks out a byte, MSB first, and checks that the slave
+// acknowledged it.
+func (i2c *SoftI2C) writeByte(b byte) error {
+	for i := 0; i < 8; i++ {
+		if err := i2c.writeBit(b&0x80 != 0); err != nil {
+			return err
+		}
+		b <<= 1
+	}
+	nack, err := i2c.readBit()
+	if err != nil {
+		return err
+	}
+	if nack {
+		return errI2CAckExpected
+	}
+	return nil
+}
+
+// readByte clocks in a byte, MSB first, and acknowledges it if ack is set. The
+// last byte of a read is not acknowledged, which tells the slave to stop
+// sending.
+func (i2c *SoftI2C) readByte(ack bool) (byte, error) {
+	var b byte
+	for i := 0; i < 8; i++ {
+		bit, err := i2c.readBit()
+		if err != nil {
+			return 0, err
+		}
+		b <<= 1
+		if bit {
+			b |= 1
+		}
+	}
+	if err := i2c.writeBit(!ack); err != nil {
+		return 0, err
+	}
+	return b, nil
+}
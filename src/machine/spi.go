@@ -4,14 +4,6 @@ package machine
 
 import "errors"
 
-// SPI phase and polarity configs CPOL and CPHA
-const (
-	Mode0 = 0
-	Mode1 = 1
-	Mode2 = 2
-	Mode3 = 3
-)
-
 var (
 	ErrTxInvalidSliceSize = errors.New("SPI write and read slices must be same size")
 )
@@ -0,0 +1,67 @@
+// +build nrf
+
+package machine
+
+// SPI9BitData is the D/C bit of a 9-bit SPI word: set for data (parameters or
+// pixels) and cleared for a command. For example, 0x2a is a command and
+// SPI9BitData|0x10 a data byte.
+const SPI9BitData = 0x100
+
+// Pack9Bit packs 9-bit words into the byte stream sent on a 3-wire display
+// interface, where every byte is preceded by its D/C bit (SPI9BitData) instead
+// of using a separate D/C pin. The words are sent MSB first, so 8 words make
+// up 9 bytes. The words are padded to a multiple of 8 with zero words, which
+// are the NOP command of MIPI DCS compatible controllers (ST7735, ST7789,
+// ILI9341 and many others), so every byte is complete.
+//
+// It returns the number of bytes written to dst, which must be at least
+// Packed9BitLen(len(words)) bytes long, otherwise ErrInvalidConfig is returned.
+// The SPI peripheral only sends whole bytes, so this is the way to drive such
+// displays; see SPIDevice.Write9Bit to send words without a buffer.
+func Pack9Bit(dst []byte, words []uint16) (int, error) {
+	n := Packed9BitLen(len(words))
+	if len(dst) < n {
+		return 0, ErrInvalidConfig
+	}
+	for i := 0; i < n; i++ {
+		dst[i] = 0
+	}
+	for i, w := range words {
+		// Word i starts at bit 9*i of the stream, counting from the MSB of
+		// the first byte.
+		bit := 9 * i
+		v := uint32(w&0x1ff) << (16 - 9) >> uint(bit%8)
+		dst[bit/8] |= byte(v >> 8)
+		dst[bit/8+1] |= byte(v)
+	}
+	return n, nil
+}
+
+// Packed9BitLen returns the number of bytes Pack9Bit needs for n words.
+func Packed9BitLen(n int) int {
+	return (n + 7) / 8 * 9
+}
+
+// Write9Bit packs 9-bit words as Pack9Bit does and sends them to the device in
+// a single chip select frame. The words are packed and sent 8 at a time, so
+// nothing is allocated and any number of words can be sent.
+func (d SPIDevice) Write9Bit(words []uint16) error {
+	if err := d.waitReady(); err != nil {
+		return err
+	}
+	d.selectDevice()
+	defer d.deselectDevice()
+	var buf [9]byte
+	for len(words) != 0 {
+		chunk := words
+		if len(chunk) > 8 {
+			chunk = chunk[:8]
+		}
+		words = words[len(chunk):]
+		n, _ := Pack9Bit(buf[:], chunk)
+		if err := d.Bus.Tx(buf[:n], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// +build nrf,spi_capture
+
+package machine
+
+import (
+	"io"
+	"runtime/interrupt"
+)
+
+// spiCaptureSize is the size in bytes of the SPI capture buffer.
+const spiCaptureSize = 4096
+
+// spiCaptureHeaderSize is the size of the header of every captured transfer:
+// the RTC ticks (8 bytes), the SPI instance number and the number of bytes
+// written and read (2 bytes each).
+const spiCaptureHeaderSize = 13
+
+// The SPI capture buffer holds the captured transfers one after the other,
+// each a header followed by the bytes written and the bytes read.
+var (
+	spiCapture     [spiCaptureSize]byte
+	spiCaptureLen  int
+	spiCaptureFull bool
+)
+
+// spiCaptureTransfer records the full contents of a transfer in the capture
+// buffer. Once a transfer doesn't fit anymore, recording stops, so that the
+// start of a sequence (such as a display initialization) is kept intact.
+func spiCaptureTransfer(spi SPI, w, r []byte) {
+	mask := interrupt.Disable()
+	defer interrupt.Restore(mask)
+	if spiCaptureFull {
+		return
+	}
+	if spiCaptureLen+spiCaptureHeaderSize+len(w)+len(r) > spiCaptureSize || len(w) > 0xffff || len(r) > 0xffff {
+		spiCaptureFull = true
+		return
+	}
+	buf := spiCapture[spiCaptureLen:]
+	ticks := Ticks()
+	for i := 0; i < 8; i++ {
+		buf[i] = byte(ticks >> (8 * uint(i)))
+	}
+	buf[8] = uint8(spi.index())
+	buf[9], buf[10] = byte(len(w)), byte(len(w)>>8)
+	buf[11], buf[12] = byte(len(r)), byte(len(r)>>8)
+	n := spiCaptureHeaderSize
+	n += copy(buf[n:], w)
+	n += copy(buf[n:], r)
+	spiCaptureLen += n
+}
+
+// SPICaptureReset clears the SPI capture buffer and restarts recording, for
+// example right before the sequence to capture. It only exists when building
+// with the spi_capture build tag.
+func SPICaptureReset() {
+	mask := interrupt.Disable()
+	spiCaptureLen = 0
+	spiCaptureFull = false
+	interrupt.Restore(mask)
+}
+
+// SPICaptureWriteCSV writes the transfers recorded since boot (or since the
+// last SPICaptureReset) to w as CSV, for offline analysis or to diff two
+// captured sequences. There is one line per transfer, after a header line:
+//
+//	time_us,bus,mosi,miso
+//	1220,0,9f000000,00ef4016
+//
+// The time is when the transfer completed, with the resolution of the RTC
+// (about 30µs). The mosi and miso columns hold the bytes written and read in
+// hex; a column is empty if no buffer was passed, for example miso for a
+// write-only transfer. The capture buffer holds 4kB: once it is full, later
+// transfers are not recorded.
+//
+// Transfers are only recorded when building with the spi_capture build tag,
+// so this costs nothing in production builds. The writer must not use an SPI
+// bus, as its transfers would be captured while the buffer is written out.
+func SPICaptureWriteCSV(w io.Writer) error {
+	if _, err := io.WriteString(w, "time_us,bus,mosi,miso\n"); err != nil {
+		return err
+	}
+	var line []byte
+	for i := 0; i < spiCaptureLen; {
+		buf := spiCapture[i:]
+		var ticks uint64
+		for j := 0; j < 8; j++ {
+			ticks |= uint64(buf[j]) << (8 * uint(j))
+		}
+		bus := buf[8]
+		nw := int(buf[9]) | int(buf[10])<<8
+		nr := int(buf[11]) | int(buf[12])<<8
+		data := buf[spiCaptureHeaderSize:]
+
+		line = appendUint(line[:0], uint64(TicksToNanoseconds(ticks)/1000))
+		line = append(line, ',')
+		line = appendUint(line, uint64(bus))
+		line = append(line, ',')
+		line = appendHex(line, data[:nw])
+		line = append(line, ',')
+		line = appendHex(line, data[nw:nw+nr])
+		line = append(line, '\n')
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		i += spiCaptureHeaderSize + nw + nr
+	}
+	return nil
+}
+
+// appendUint appends the decimal representation of n to buf.
+func appendUint(buf []byte, n uint64) []byte {
+	var digits [20]byte
+	i := len(digits)
+	for {
+		i--
+		digits[i] = byte('0' + n%10)
+		n /= 10
+		if n == 0 {
+			break
+		}
+	}
+	return append(buf, digits[i:]...)
+}
+
+// appendHex appends the bytes in data to buf as lowercase hex digits.
+func appendHex(buf []byte, data []byte) []byte {
+	const hexDigits = "0123456789abcdef"
+	for _, b := range data {
+		buf = append(buf, hexDigits[b>>4], hexDigits[b&0xf])
+	}
+	return buf
+}
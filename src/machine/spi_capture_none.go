@@ -0,0 +1,18 @@
+// +build nrf,!spi_capture
+
+package machine
+
+import "io"
+
+// spiCaptureTransfer does nothing: SPI capture is disabled.
+func spiCaptureTransfer(spi SPI, w, r []byte) {}
+
+// SPICaptureReset does nothing, as SPI transfers are only captured when
+// building with the spi_capture build tag.
+func SPICaptureReset() {}
+
+// SPICaptureWriteCSV writes nothing, as SPI transfers are only captured when
+// building with the spi_capture build tag.
+func SPICaptureWriteCSV(w io.Writer) error {
+	return nil
+}
@@ -0,0 +1,552 @@
+// +build nrf
+
+package machine
+
+import "errors"
+
+var (
+	ErrVerifyFailed = errors.New("machine: data read back does not match data written")
+	ErrNoDevice     = errors.New("machine: no device responded")
+)
+
+// SPIDevice is a single device on a (possibly shared) SPI bus, selected by its
+// own chip select pin. The chip select pin is active low: it is driven low for
+// the duration of each transfer and high otherwise.
+//
+// The bus itself must be configured separately, usually once for all devices
+// that share it.
+//
+// SPIDevice implements RegisterBus using the most common register convention
+// of SPI sensors: the register address is sent first, with the most
+// significant bit set for a read and cleared for a write. Reading or writing
+// several bytes accesses consecutive registers in one chip select frame, which
+// relies on the device incrementing the address by itself. Some devices (such
+// as the LIS3DH and other ST sensors) only do so when a flag bit is set in the
+// address byte: set AutoIncrement to that bit (0x40 for those) and it is set
+// for every access of more than one byte.
+//
+// CSSetupNS is the minimum time in nanoseconds between asserting the chip
+// select and the first clock edge, and CSHoldNS the minimum time between the
+// last clock edge and deasserting the chip select, for devices that need them.
+// The delays are rounded up to the delay granularity of the chip (1µs on the
+// nrf52). Zero means no extra delay.
+//
+// GapNS is the minimum idle time in nanoseconds between two transfers of a
+// transaction started with Begin, for devices that need a gap between a
+// command and its parameters within one chip select frame. It is rounded up
+// the same way.
+//
+// If Frequency is set, the bus is switched to the frequency, Mode and
+// LSBFirst of this device before every transfer, as with spidev on Linux, so
+// devices with different settings can share a bus without reconfiguring it by
+// hand. Only the registers that differ are written, so this is cheap when
+// consecutive transfers go to the same device. If Frequency is zero, the bus is
+// used as configured.
+//
+// MaxFrequency is the highest SCK frequency the device supports, if not zero.
+// The bus never runs faster than that while the device is selected: for a
+// device without its own Frequency, the bus frequency is lowered to
+// MaxFrequency when another device left it higher, and a Frequency above
+// MaxFrequency is lowered too. Frequencies are rounded down to one that the
+// hardware supports, so the limit is always honored. Set it on every device of
+// a shared bus that can't stand the fastest frequency in use.
+//
+// If ReadyTimeoutUS is set, ReadyPin is a data ready or busy output of the
+// device that is at ReadyLevel when the device is ready. Transfer and Tx wait
+// for it before starting, and WriteThenRead waits for it between the command
+// and the read phase, for up to ReadyTimeoutUS microseconds, returning
+// ErrTimeout if the device doesn't become ready in time. The pin must be
+// configured as an input.
+//
+// PreTransfer and PostTransfer, if set, are called around every chip select
+// frame: PreTransfer just before the chip select is asserted (after the bus
+// settings have been applied), and PostTransfer just after it is deasserted.
+// They are meant for device specific quirks that don't fit the chip select
+// model, such as an enable line that must be toggled before each access or an
+// extra delay after it. A transaction started with Begin calls them once, not
+// around each of its transfers.
+type SPIDevice struct {
+	Bus       SPI
+	CS        Pin
+	CSSetupNS uint32
+	CSHoldNS  uint32
+	GapNS     uint32
+
+	Frequency    uint32
+	MaxFrequency uint32
+	Mode         uint8
+	LSBFirst     bool
+
+	AutoIncrement uint8
+
+	ReadyPin       Pin
+	ReadyLevel     bool
+	ReadyTimeoutUS uint32
+
+	PreTransfer  func()
+	PostTransfer func()
+}
+
+// Configure configures the chip select pin of the device as an output and
+// deasserts it, without briefly selecting the device.
+func (d SPIDevice) Configure() {
+	d.CS.ConfigureOutput(true)
+}
+
+// selectDevice applies the bus settings of the device, if any, calls the
+// PreTransfer hook, asserts the chip select and waits for the setup time. The
+// settings are applied first, so that the device doesn't see the clock change
+// its idle level.
+func (d SPIDevice) selectDevice() {
+	switch {
+	case d.Frequency != 0:
+		freq := d.Frequency
+		if d.MaxFrequency != 0 && freq > d.MaxFrequency {
+			freq = d.MaxFrequency
+		}
+		d.Bus.applySettings(freq, d.Mode, d.LSBFirst)
+	case d.MaxFrequency != 0 && d.Bus.frequency() > d.MaxFrequency:
+		d.Bus.applyFrequency(d.MaxFrequency)
+	}
+	if d.PreTransfer != nil {
+		d.PreTransfer()
+	}
+	d.CS.Low()
+	if d.CSSetupNS != 0 {
+		delayNanoseconds(d.CSSetupNS)
+	}
+}
+
+// deselectDevice waits for the hold time, deasserts the chip select and calls
+// the PostTransfer hook. All transfers return only after the last byte has
+// been clocked, so the hold time starts at the last clock edge.
+func (d SPIDevice) deselectDevice() {
+	if d.CSHoldNS != 0 {
+		delayNanoseconds(d.CSHoldNS)
+	}
+	d.CS.High()
+	if d.PostTransfer != nil {
+		d.PostTransfer()
+	}
+}
+
+// waitReady waits until the ready pin is at its ready level, if the device has
+// one.
+func (d SPIDevice) waitReady() error {
+	if d.ReadyTimeoutUS == 0 {
+		return nil
+	}
+	for i := uint32(0); d.ReadyPin.Get() != d.ReadyLevel; i++ {
+		if i == d.ReadyTimeoutUS {
+			return ErrTimeout
+		}
+		delayNanoseconds(1000)
+	}
+	return nil
+}
+
+// Transfer writes/reads a single byte to this device, asserting the chip
+// select around it.
+func (d SPIDevice) Transfer(w byte) (byte, error) {
+	if err := d.waitReady(); err != nil {
+		return 0, err
+	}
+	d.selectDevice()
+	r, err := d.Bus.Transfer(w)
+	d.deselectDevice()
+	return r, err
+}
+
+// Tx handles read/write operation for this device, asserting the chip select
+// for the whole transfer. See SPI.Tx for the different ways it can be called.
+func (d SPIDevice) Tx(w, r []byte) error {
+	if err := d.waitReady(); err != nil {
+		return err
+	}
+	d.selectDevice()
+	err := d.Bus.Tx(w, r)
+	d.deselectDevice()
+	return err
+}
+
+// WriteThenRead writes cmd and then reads resp from this device in a single
+// chip select frame. See SPI.WriteThenRead for details. If the device has a
+// ready pin, the clock pauses between the command and the response until the
+// device is ready.
+func (d SPIDevice) WriteThenRead(cmd, resp []byte) error {
+	d.selectDevice()
+	var err error
+	if d.ReadyTimeoutUS == 0 {
+		err = d.Bus.WriteThenRead(cmd, resp)
+	} else {
+		err = d.Bus.Tx(cmd, nil)
+		if err == nil {
+			err = d.waitReady()
+		}
+		if err == nil {
+			err = d.Bus.Tx(nil, resp)
+		}
+	}
+	d.deselectDevice()
+	return err
+}
+
+// WriteThenReadDummy writes cmd, clocks dummyCycles dummy cycles and then reads
+// resp from this device in a single chip select frame. See
+// SPI.WriteThenReadDummy for details.
+func (d SPIDevice) WriteThenReadDummy(cmd []byte, dummyCycles int, resp []byte) error {
+	d.selectDevice()
+	err := d.Bus.WriteThenReadDummy(cmd, dummyCycles, resp)
+	d.deselectDevice()
+	return err
+}
+
+// Probe checks whether this device is connected, with the chip select asserted
+// for the whole command and response. See SPI.Probe for details.
+func (d SPIDevice) Probe(cmd, expect []byte) (bool, error) {
+	d.selectDevice()
+	ok, err := d.Bus.Probe(cmd, expect)
+	d.deselectDevice()
+	return ok, err
+}
+
+// CheckPresence reads the given identification register (such as WHO_AM_I)
+// with ReadRegister and returns ErrNoDevice if the response looks like nobody
+// answered, see IsFloatingResponse. This catches a device that is not
+// connected or not powered during bring-up, without knowing its ID. If the ID
+// is known, Probe is more reliable.
+func (d SPIDevice) CheckPresence(register uint8) error {
+	var id [1]byte
+	if err := d.ReadRegister(register, id[:]); err != nil {
+		return err
+	}
+	if IsFloatingResponse(id[:]) {
+		return ErrNoDevice
+	}
+	return nil
+}
+
+// IsFloatingResponse returns whether data, read from an SPI device, is all
+// 0x00 or all 0xff bytes. This is what a read returns when no device drives
+// SDI: the line floats or is pulled to one level, so every bit reads the
+// same. It is only a heuristic, as some valid data (such as erased flash)
+// reads the same way, so only use it where such data is not expected.
+func IsFloatingResponse(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	first := data[0]
+	if first != 0x00 && first != 0xff {
+		return false
+	}
+	for _, b := range data[1:] {
+		if b != first {
+			return false
+		}
+	}
+	return true
+}
+
+// SPITransaction is a sequence of transfers to a device within a single chip
+// select frame, started with SPIDevice.Begin.
+type SPITransaction struct {
+	d       SPIDevice
+	started bool
+}
+
+// Begin asserts the chip select and starts a transaction, which keeps the
+// device selected for all its transfers until End is called:
+//
+//	t := dev.Begin()
+//	t.Tx([]byte{cmd}, nil)
+//	t.Tx(params, nil)
+//	t.End()
+//
+// Successive transfers are separated by at least GapNS, using a busy-wait
+// delay, so the gap is not affected by the scheduler.
+func (d SPIDevice) Begin() SPITransaction {
+	d.selectDevice()
+	return SPITransaction{d: d}
+}
+
+// Tx transfers data within the transaction, after waiting for the configured
+// gap if this is not the first transfer. See SPI.Tx for the different ways it
+// can be called.
+func (t *SPITransaction) Tx(w, r []byte) error {
+	if t.started && t.d.GapNS != 0 {
+		delayNanoseconds(t.d.GapNS)
+	}
+	t.started = true
+	return t.d.Bus.Tx(w, r)
+}
+
+// End finishes the transaction and deasserts the chip select.
+func (t *SPITransaction) End() {
+	t.d.deselectDevice()
+}
+
+// ReadRegister reads len(data) bytes starting at the given register, by
+// sending the register address with bit 7 set and then reading the data in the
+// same chip select frame. This is the usual burst read of consecutive
+// registers, see AutoIncrement.
+func (d SPIDevice) ReadRegister(register uint8, data []byte) error {
+	return d.WriteThenRead([]byte{d.registerAddress(register, len(data)) | 0x80}, data)
+}
+
+// WriteRegister writes data starting at the given register, by sending the
+// register address with bit 7 cleared followed by the data in the same chip
+// select frame.
+func (d SPIDevice) WriteRegister(register uint8, data []byte) error {
+	d.selectDevice()
+	err := d.Bus.Tx([]byte{d.registerAddress(register, len(data)) &^ 0x80}, nil)
+	if err == nil {
+		err = d.Bus.Tx(data, nil)
+	}
+	d.deselectDevice()
+	return err
+}
+
+// registerAddress returns the address byte for an access of n bytes starting at
+// register, without the read bit.
+func (d SPIDevice) registerAddress(register uint8, n int) uint8 {
+	if n > 1 {
+		register |= d.AutoIncrement
+	}
+	return register
+}
+
+// SPIDisplay is an SPI display controller with a data/command (D/C) pin, as
+// used by most TFT and OLED displays (ST7735, ST7789, ILI9341, SSD1306 and
+// many more): the D/C pin is low while a command is sent and high while its
+// parameters or pixel data are sent.
+type SPIDisplay struct {
+	Device SPIDevice
+	DC     Pin
+}
+
+// Configure configures the chip select and D/C pins as outputs. The bus must
+// be configured separately.
+func (d SPIDisplay) Configure() {
+	d.Device.Configure()
+	d.DC.ConfigureOutput(true)
+}
+
+// Command sends a command to the display, with the D/C pin low.
+func (d SPIDisplay) Command(b []byte) error {
+	d.DC.Low()
+	return d.Device.Tx(b, nil)
+}
+
+// Data sends parameters or pixel data to the display, with the D/C pin high.
+func (d SPIDisplay) Data(b []byte) error {
+	d.DC.High()
+	return d.Device.Tx(b, nil)
+}
+
+// Data16 sends RGB565 pixels (or other 16-bit data) to the display, most
+// significant byte first, with the D/C pin high. See SPI.Tx16.
+func (d SPIDisplay) Data16(pixels []uint16) error {
+	d.DC.High()
+	d.Device.selectDevice()
+	err := d.Device.Bus.Tx16(pixels, nil)
+	d.Device.deselectDevice()
+	return err
+}
+
+// CommandData sends a command followed by its parameters in a single chip
+// select frame, switching the D/C pin in between, which is what most
+// controllers expect for commands with parameters.
+func (d SPIDisplay) CommandData(cmd byte, params []byte) error {
+	d.Device.selectDevice()
+	d.DC.Low()
+	err := d.Device.Bus.Tx([]byte{cmd}, nil)
+	if err == nil && len(params) != 0 {
+		d.DC.High()
+		err = d.Device.Bus.Tx(params, nil)
+	}
+	d.Device.deselectDevice()
+	return err
+}
+
+// ResetSequence does the hardware reset of a display controller, or of any
+// chip with an active low reset input: it drives rst low for lowMs
+// milliseconds, then high, and waits highMs milliseconds for the controller to
+// come out of reset before returning. The datasheet of the controller lists
+// both times; for example the ST7789 needs at least 10µs low and 120ms before
+// the first command. The pin is configured as an output. If rst is NoPin,
+// because the reset input is tied to the board reset or not connected, it does
+// nothing.
+//
+// The delays busy-wait, so other goroutines don't run in the meantime.
+func ResetSequence(rst Pin, lowMs, highMs uint32) {
+	if rst == NoPin {
+		return
+	}
+	rst.ConfigureOutput(false)
+	delayMilliseconds(lowMs)
+	rst.High()
+	delayMilliseconds(highMs)
+}
+
+// delayMilliseconds busy-waits for the given number of milliseconds.
+func delayMilliseconds(ms uint32) {
+	for i := uint32(0); i < ms; i++ {
+		delayNanoseconds(1000000)
+	}
+}
+
+// SPIChain is a daisy chain of identical devices, such as shift registers or
+// MAX7219 LED drivers, that share a single chip select: the SDO pin is
+// connected to the data input of the first device, the data output of every
+// device to the input of the next, and all of them latch the data shifted
+// into them when the chip select is deasserted.
+//
+// Devices are numbered from 0 for the first device in the chain. The data for
+// the last device must be sent first, as it has to be shifted through all the
+// others, which Write takes care of.
+type SPIChain struct {
+	Device SPIDevice
+	Length int // number of devices in the chain
+}
+
+// Write sends one frame to every device in the chain in a single chip select
+// frame: frames[i] is the data for device i. There must be exactly Length
+// frames, otherwise ErrInvalidConfig is returned. The frames are sent one
+// after the other without building a combined buffer, so nothing is allocated.
+func (c SPIChain) Write(frames [][]byte) error {
+	if len(frames) != c.Length {
+		return ErrInvalidConfig
+	}
+	c.Device.selectDevice()
+	var err error
+	for i := len(frames) - 1; i >= 0 && err == nil; i-- {
+		err = c.Device.Bus.Tx(frames[i], nil)
+	}
+	c.Device.deselectDevice()
+	return err
+}
+
+// WriteAll sends the same frame to all devices in the chain in a single chip
+// select frame, for example a configuration command.
+func (c SPIChain) WriteAll(frame []byte) error {
+	c.Device.selectDevice()
+	var err error
+	for i := 0; i < c.Length && err == nil; i++ {
+		err = c.Device.Bus.Tx(frame, nil)
+	}
+	c.Device.deselectDevice()
+	return err
+}
+
+// ShiftRegister is a chain of 74HC595 (or compatible) shift registers used as
+// an output expander, each adding 8 outputs. SDO and SCK of the bus are
+// connected to SER and SRCLK of the first register, QH' of every register to
+// SER of the next one, and the chip select pin of Device to RCLK of all of
+// them: the outputs change at once when it is deasserted, on the rising edge.
+// OE must be tied low and SRCLR high. The registers sample SER on the rising
+// edge of SRCLK, so the bus must use mode 0 with the most significant bit
+// first.
+//
+// Outputs are numbered from 0 for QA of the first register in the chain up to
+// QH of the last one, which is output 8*Length-1. Up to 4 registers (32
+// outputs) are supported. The state of all outputs is kept in the
+// ShiftRegister, so that SetPin can change a single output: use it through a
+// pointer.
+type ShiftRegister struct {
+	Device SPIDevice
+	Length int // number of registers in the chain
+
+	value uint32
+}
+
+// Configure configures the latch pin as an output and clears all outputs, as
+// their state is undefined after power up.
+func (s *ShiftRegister) Configure() error {
+	s.Device.Configure()
+	return s.Write(0)
+}
+
+// Write sets all outputs at once: bit n of value is output n. The bytes for
+// all registers are sent in one chip select frame, starting with the last
+// register in the chain, and latched together at the end.
+func (s *ShiftRegister) Write(value uint32) error {
+	if s.Length < 1 || s.Length > 4 {
+		return ErrInvalidConfig
+	}
+	var buf [4]byte
+	for i := 0; i < s.Length; i++ {
+		buf[i] = byte(value >> (8 * uint(s.Length-1-i)))
+	}
+	if err := s.Device.Tx(buf[:s.Length], nil); err != nil {
+		return err
+	}
+	s.value = value
+	return nil
+}
+
+// SetPin sets output n to the given value, leaving the other outputs as they
+// are. It shifts out the state of the whole chain, so when changing several
+// outputs at once, Write is faster and changes them all at the same time.
+func (s *ShiftRegister) SetPin(n int, value bool) error {
+	if n < 0 || n >= 8*s.Length {
+		return ErrInvalidConfig
+	}
+	v := s.value &^ (1 << uint(n))
+	if value {
+		v |= 1 << uint(n)
+	}
+	return s.Write(v)
+}
+
+// Value returns the current state of all outputs, as last written.
+func (s *ShiftRegister) Value() uint32 {
+	return s.value
+}
+
+// WriteVerify writes data with write, reads it back into a buffer of the same
+// length with read and compares the two, retrying the whole operation until the
+// data matches or the number of attempts is used up. In that case it returns
+// ErrVerifyFailed, or the last error returned by write or read.
+//
+// The write and read functions are device specific, for example a flash chip
+// needs a write enable command before programming a page and has to be polled
+// until the write is finished before reading back:
+//
+//	err := machine.WriteVerify(page, 3, func(data []byte) error {
+//		return flash.programPage(addr, data)
+//	}, func(buf []byte) error {
+//		return flash.read(addr, buf)
+//	})
+//
+// SPI transfers on the nrf are never partial, so a failed attempt always
+// rewrites all the data.
+func WriteVerify(data []byte, attempts int, write, read func(buf []byte) error) error {
+	buf := make([]byte, len(data))
+	err := ErrVerifyFailed
+	for i := 0; i < attempts; i++ {
+		if err = write(data); err != nil {
+			continue
+		}
+		if err = read(buf); err != nil {
+			continue
+		}
+		if bytesEqual(buf, data) {
+			return nil
+		}
+		err = ErrVerifyFailed
+	}
+	return err
+}
+
+// bytesEqual returns whether a and b have the same contents.
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
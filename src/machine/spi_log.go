@@ -0,0 +1,57 @@
+// +build nrf,spi_log
+
+package machine
+
+// spiLogSize is the number of transfers kept in the SPI transfer log.
+const spiLogSize = 16
+
+// SPILogEntry describes a single SPI transfer in the log returned by
+// SPI.Dump.
+type SPILogEntry struct {
+	Ticks uint64  // RTC ticks at the end of the transfer, see Ticks
+	Bus   uint8   // SPI instance number
+	Len   int     // number of bytes written or read
+	W     [4]byte // first bytes written (zero for a read-only transfer)
+	R     [4]byte // first bytes read (zero if the read bytes were discarded)
+}
+
+// Ring buffer of the last spiLogSize transfers of all SPI instances.
+var (
+	spiLog      [spiLogSize]SPILogEntry
+	spiLogCount uint32
+)
+
+// spiLogTransfer records a transfer in the SPI transfer log.
+func spiLogTransfer(spi SPI, w, r []byte) {
+	e := &spiLog[spiLogCount%spiLogSize]
+	spiLogCount++
+	e.Ticks = Ticks()
+	e.Bus = uint8(spi.index())
+	e.Len = len(w)
+	if len(r) > e.Len {
+		e.Len = len(r)
+	}
+	e.W = [4]byte{}
+	e.R = [4]byte{}
+	copy(e.W[:], w)
+	copy(e.R[:], r)
+}
+
+// Dump returns the last transfers of this SPI instance from the transfer log,
+// oldest first. The log keeps the last 16 transfers of all instances together.
+// It only exists when building with the spi_log build tag: without it, no
+// transfers are recorded and Dump returns nil.
+func (spi SPI) Dump() []SPILogEntry {
+	var entries []SPILogEntry
+	start := uint32(0)
+	if spiLogCount > spiLogSize {
+		start = spiLogCount - spiLogSize
+	}
+	for i := start; i < spiLogCount; i++ {
+		e := spiLog[i%spiLogSize]
+		if int(e.Bus) == spi.index() {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
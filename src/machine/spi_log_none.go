@@ -0,0 +1,22 @@
+// +build nrf,!spi_log
+
+package machine
+
+// SPILogEntry describes a single SPI transfer in the log returned by
+// SPI.Dump. The log is only kept when building with the spi_log build tag.
+type SPILogEntry struct {
+	Ticks uint64  // RTC ticks at the end of the transfer, see Ticks
+	Bus   uint8   // SPI instance number
+	Len   int     // number of bytes written or read
+	W     [4]byte // first bytes written (zero for a read-only transfer)
+	R     [4]byte // first bytes read (zero if the read bytes were discarded)
+}
+
+// spiLogTransfer does nothing: the SPI transfer log is disabled.
+func spiLogTransfer(spi SPI, w, r []byte) {}
+
+// Dump returns nil, as the SPI transfer log is only kept when building with
+// the spi_log build tag.
+func (spi SPI) Dump() []SPILogEntry {
+	return nil
+}
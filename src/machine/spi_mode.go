@@ -0,0 +1,15 @@
+package machine
+
+// SPI phase and polarity configs CPOL and CPHA. The mode number is CPOL in
+// bit 1 and CPHA in bit 0, so for example Mode3 is CPOL=1, CPHA=1.
+//
+//	Mode0: CPOL=0 (clock idles low),  CPHA=0 (sample on the leading edge)
+//	Mode1: CPOL=0 (clock idles low),  CPHA=1 (sample on the trailing edge)
+//	Mode2: CPOL=1 (clock idles high), CPHA=0 (sample on the leading edge)
+//	Mode3: CPOL=1 (clock idles high), CPHA=1 (sample on the trailing edge)
+const (
+	Mode0 = 0
+	Mode1 = 1
+	Mode2 = 2
+	Mode3 = 3
+)
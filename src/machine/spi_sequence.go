@@ -0,0 +1,136 @@
+// +build nrf
+
+package machine
+
+// spiStepKind is the kind of operation of an SPIStep.
+type spiStepKind uint8
+
+const (
+	spiStepWrite spiStepKind = iota
+	spiStepCommand
+	spiStepSetPin
+	spiStepDelay
+)
+
+// SPIStep is a single step of an SPISequence. Steps are created with SPIWrite,
+// SPICommand, SPISetPin and SPIDelay.
+type SPIStep struct {
+	kind spiStepKind
+	cmd  byte
+	data []byte
+	pin  Pin
+	high bool
+	us   uint32
+}
+
+// SPIWrite returns a step that writes data to the device in its own chip
+// select frame. With RunDisplay, the data is sent as pixel data or parameters
+// (D/C high).
+func SPIWrite(data ...byte) SPIStep {
+	return SPIStep{kind: spiStepWrite, data: data}
+}
+
+// SPICommand returns a step that sends a command byte followed by its
+// parameters in a single chip select frame. With RunDisplay, the D/C pin is
+// low for the command and high for the parameters, as with
+// SPIDisplay.CommandData.
+func SPICommand(cmd byte, params ...byte) SPIStep {
+	return SPIStep{kind: spiStepCommand, cmd: cmd, data: params}
+}
+
+// SPISetPin returns a step that sets an output pin high or low, for example a
+// reset or power enable pin of the device.
+func SPISetPin(p Pin, high bool) SPIStep {
+	return SPIStep{kind: spiStepSetPin, pin: p, high: high}
+}
+
+// SPIDelay returns a step that waits for the given number of microseconds.
+func SPIDelay(us uint32) SPIStep {
+	return SPIStep{kind: spiStepDelay, us: us}
+}
+
+// SPISequence is a list of steps that are run one after the other, such as the
+// initialization sequence of a display controller. Declaring the sequence as
+// a table, usually copied from the datasheet or a reference driver, is less
+// error prone than a long list of calls with their error checks:
+//
+//	var initSequence = machine.SPISequence{
+//		machine.SPISetPin(rst, false),
+//		machine.SPIDelay(10),
+//		machine.SPISetPin(rst, true),
+//		machine.SPIDelay(120000),
+//		machine.SPICommand(0x11), // sleep out
+//		machine.SPIDelay(5000),
+//		machine.SPICommand(0x3a, 0x55), // 16-bit pixels
+//		machine.SPICommand(0x29), // display on
+//	}
+//
+//	err := initSequence.RunDisplay(display)
+//
+// The steps are run in software. The delays busy-wait and are accurate to the
+// delay granularity of the chip (1µs on the nrf52), but are at least as long as
+// specified, which is what datasheets require. The pins used by SPISetPin must
+// be configured as outputs.
+type SPISequence []SPIStep
+
+// Run runs the sequence on the given device. It stops at the first transfer
+// that fails and returns its error.
+func (seq SPISequence) Run(d SPIDevice) error {
+	for _, step := range seq {
+		var err error
+		switch step.kind {
+		case spiStepWrite:
+			err = d.Tx(step.data, nil)
+		case spiStepCommand:
+			d.selectDevice()
+			err = d.Bus.Tx([]byte{step.cmd}, nil)
+			if err == nil && len(step.data) != 0 {
+				err = d.Bus.Tx(step.data, nil)
+			}
+			d.deselectDevice()
+		default:
+			step.run()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunDisplay runs the sequence on the given display, switching its D/C pin for
+// commands and data. It stops at the first transfer that fails and returns its
+// error.
+func (seq SPISequence) RunDisplay(d SPIDisplay) error {
+	for _, step := range seq {
+		var err error
+		switch step.kind {
+		case spiStepWrite:
+			err = d.Data(step.data)
+		case spiStepCommand:
+			err = d.CommandData(step.cmd, step.data)
+		default:
+			step.run()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run runs a step that doesn't use the bus.
+func (step SPIStep) run() {
+	switch step.kind {
+	case spiStepSetPin:
+		step.pin.Set(step.high)
+	case spiStepDelay:
+		us := step.us
+		for ; us >= 1000; us -= 1000 {
+			delayNanoseconds(1000000)
+		}
+		if us != 0 {
+			delayNanoseconds(us * 1000)
+		}
+	}
+}
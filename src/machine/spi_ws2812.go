@@ -0,0 +1,92 @@
+// +build nrf
+
+package machine
+
+// WS2812 drives a chain of WS2812 (NeoPixel) LEDs using the SDO pin of an SPI
+// bus. Every bit of LED data is sent as 4 SPI bits, 1000 for a zero and 1110
+// for a one, so that the SPI clock generates the tight timing of the LED
+// protocol instead of the CPU. The bus must be configured for 4MHz, mode 0 and
+// MSB first:
+//
+//	spi.Configure(machine.SPIConfig{
+//		Frequency: 4000000,
+//		SCK:       unusedPin, // the SPI peripheral always drives a clock pin
+//		SDO:       neopixelPin,
+//	})
+//	leds := machine.WS2812{Bus: spi}
+//	leds.Write(grb)
+//
+// At 4MHz an SPI bit takes 250ns, so a zero is 250ns high and 750ns low and a
+// one is 750ns high and 250ns low, for a bit period of 1µs. This is within the
+// timing tolerance of WS2812B and SK6812 LEDs.
+//
+// The legacy SPI peripheral has no DMA, so an interrupt during Write can
+// stretch the low time between two bytes. The LEDs only latch the data after
+// a low time of about 50µs (280µs for newer WS2812B), so short interrupts are
+// harmless, but long interrupt handlers may cause the rest of the chain to
+// show stale colors.
+type WS2812 struct {
+	Bus SPI
+}
+
+// ws2812ResetBytes is the number of zero bytes sent after the LED data, which
+// keeps the data line low for 300µs at 4MHz so that the LEDs latch the data.
+const ws2812ResetBytes = 150
+
+// ws2812Chunk is the number of LED data bytes encoded before calling Tx, to
+// limit the stack usage while keeping the number of gaps between SPI
+// transfers small.
+const ws2812Chunk = 16
+
+// Write sends the given LED data, which is usually 3 bytes per LED in green,
+// red, blue order (4 bytes for RGBW LEDs), followed by the reset gap after
+// which the LEDs show the new colors.
+func (d WS2812) Write(buf []byte) error {
+	var spibuf [ws2812Chunk * 4]byte
+	for len(buf) != 0 {
+		n := len(buf)
+		if n > ws2812Chunk {
+			n = ws2812Chunk
+		}
+		for i, c := range buf[:n] {
+			ws2812Encode(spibuf[i*4:i*4+4], c)
+		}
+		if err := d.Bus.Tx(spibuf[:n*4], nil); err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+
+	// Send the reset gap. Every byte is zero, so the data line stays low.
+	for i := range spibuf {
+		spibuf[i] = 0
+	}
+	for n := ws2812ResetBytes; n > 0; n -= len(spibuf) {
+		chunk := spibuf[:]
+		if n < len(chunk) {
+			chunk = chunk[:n]
+		}
+		if err := d.Bus.Tx(chunk, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ws2812Encode encodes the 8 bits of c, MSB first, as 4 SPI bits each into the
+// 4 bytes of buf.
+func ws2812Encode(buf []byte, c byte) {
+	for i := range buf {
+		var b byte
+		for j := 0; j < 2; j++ {
+			b <<= 4
+			if c&0x80 != 0 {
+				b |= 0xe // 1110
+			} else {
+				b |= 0x8 // 1000
+			}
+			c <<= 1
+		}
+		buf[i] = b
+	}
+}
@@ -2,14 +2,43 @@
 
 package machine
 
-import "errors"
+import (
+	"errors"
+	_ "unsafe" // for go:linkname
+)
 
 var errUARTBufferEmpty = errors.New("UART buffer empty")
 
+// UARTParity is the parity bit setting of a UART. Not all targets support all
+// parity settings.
+type UARTParity uint8
+
+const (
+	ParityNone UARTParity = iota
+	ParityEven
+	ParityOdd
+)
+
+// UARTConfig is used to store config info for a UART. The zero value of
+// Parity and StopBits means no parity and one stop bit (8N1).
+//
+// RXBufferSize is the size of the receive ring buffer in bytes. It must be a
+// power of two up to 32768; zero keeps the current size (128 bytes by
+// default). Any other size is allocated in RAM in addition to the default
+// buffer, so it costs that many bytes on top of it. Not all targets support
+// changing it.
+//
+// TXBufferSize is the size of the transmit ring buffer in bytes, with the same
+// restrictions. On targets that support it, a non-zero size makes writes
+// buffered: they return once the data is queued instead of once it is sent.
 type UARTConfig struct {
-	BaudRate uint32
-	TX       Pin
-	RX       Pin
+	BaudRate     uint32
+	TX           Pin
+	RX           Pin
+	Parity       UARTParity
+	StopBits     uint8
+	RXBufferSize int
+	TXBufferSize int
 }
 
 // To implement the UART interface for a board, you must declare a concrete type as follows:
@@ -67,6 +96,30 @@ func (uart UART) ReadByte() (byte, error) {
 	return buf, nil
 }
 
+// ReadByteBlocking reads a single byte from the RX buffer. Unlike ReadByte,
+// which returns an error right away when the buffer is empty, it waits until a
+// byte arrives. The goroutine is paused while it waits and woken up by the
+// receive interrupt, so other goroutines keep running, and the CPU sleeps when
+// there is nothing else to do. Use Buffered to check whether data is available
+// without blocking.
+//
+// Only one goroutine at a time may wait in ReadByteBlocking, on any UART, as
+// the wake up is shared by all of them.
+func (uart UART) ReadByteBlocking() byte {
+	for {
+		if b, ok := uart.Buffer.Get(); ok {
+			return b
+		}
+		uartRXWait()
+	}
+}
+
+//go:linkname uartRXWait runtime.machineUARTRXWait
+func uartRXWait()
+
+//go:linkname uartRXNotify runtime.machineUARTRXNotify
+func uartRXNotify()
+
 // Buffered returns the number of bytes currently stored in the RX buffer.
 func (uart UART) Buffered() int {
 	return int(uart.Buffer.Used())
@@ -76,4 +129,5 @@ func (uart UART) Buffered() int {
 // Usually called by the IRQ handler for a machine.
 func (uart UART) Receive(data byte) {
 	uart.Buffer.Put(data)
+	uartRXNotify()
 }
@@ -242,6 +242,7 @@ func (u *UART) handleStatusInterrupt(interrupt.Interrupt) {
 
 			for {
 				u.Buffer.Put(u.D.Get())
+				uartRXNotify()
 				avail--
 				if avail <= 0 {
 					break
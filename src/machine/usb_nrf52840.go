@@ -95,6 +95,13 @@ func (usbcdc *USBCDC) Configure(config UARTConfig) {
 	usbcdc.interrupt.SetPriority(0x40) // interrupt priority 2 (lower number means more important)
 	usbcdc.interrupt.Enable()
 
+	// USB needs the external crystal oscillator. With a SoftDevice, the
+	// CLOCK peripheral may not be touched and the bootloader leaves the
+	// crystal running.
+	if !hasSoftDevice {
+		RequestHFXO()
+	}
+
 	// enable USB
 	nrf.USBD.ENABLE.Set(1)
 
@@ -31,9 +31,15 @@ func init() {
 }
 
 func initLFCLK() {
-	if machine.HasLowFrequencyCrystal {
-		nrf.CLOCK.LFCLKSRC.Set(nrf.CLOCK_LFCLKSTAT_SRC_Xtal)
+	source := machine.LowFrequencyClockSource()
+	if source == machine.LFCLKSourceSynth {
+		// The synthesized LFCLK needs the HFCLK to run from the crystal.
+		nrf.CLOCK.TASKS_HFCLKSTART.Set(1)
+		for nrf.CLOCK.EVENTS_HFCLKSTARTED.Get() == 0 {
+		}
+		nrf.CLOCK.EVENTS_HFCLKSTARTED.Set(0)
 	}
+	nrf.CLOCK.LFCLKSRC.Set(uint32(source))
 	nrf.CLOCK.TASKS_LFCLKSTART.Set(1)
 	for nrf.CLOCK.EVENTS_LFCLKSTARTED.Get() == 0 {
 	}
@@ -27,7 +27,7 @@ func waitForEvents() {
 		if nrf.DEVICE == "nrf51" {
 			// sd_app_evt_wait: SOC_SVC_BASE_NOT_AVAILABLE + 29
 			arm.SVCall0(0x2B + 29)
-		} else if nrf.DEVICE == "nrf52" || nrf.DEVICE == "nrf52840" {
+		} else if nrf.DEVICE == "nrf52" || nrf.DEVICE == "nrf52833" || nrf.DEVICE == "nrf52840" {
 			// sd_app_evt_wait: SOC_SVC_BASE_NOT_AVAILABLE + 21
 			arm.SVCall0(0x2C + 21)
 		} else {
@@ -0,0 +1,19 @@
+package runtime
+
+// uartRXCond is notified by the UART receive interrupts of the machine package
+// and waited on by machine.UART.ReadByteBlocking, so that a goroutine waiting
+// for data is paused instead of polling the receive buffer.
+var uartRXCond Cond
+
+// machineUARTRXWait waits until uartRXCond is notified. It is called from the
+// machine package through go:linkname, as the machine package can't import the
+// runtime.
+func machineUARTRXWait() {
+	uartRXCond.Wait()
+}
+
+// machineUARTRXNotify notifies uartRXCond. It is called from UART interrupts
+// in the machine package.
+func machineUARTRXNotify() {
+	uartRXCond.Notify()
+}